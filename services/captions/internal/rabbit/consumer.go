@@ -165,6 +165,7 @@ func (c *Consumer) handle(ctx context.Context, d amqp.Delivery, producer *Produc
 		return
 	}
 
+	producer.PublishStartCensor(captionsReadyEvent)
 	producer.PublishCaptionsReady(captionsReadyEvent)
 	producer.PublishUpdateVideoStatus(types.UpdateVideoStatusEvent{
 		VideoId: req.VideoId,
@@ -63,10 +63,17 @@ func (p *Producer) PublishUpdateVideoStatus(event types.UpdateVideoStatusEvent)
 	return p.publishWithRetry("updateVideoStatus", event, 3)
 }
 
-func (p *Producer) PublishCaptionsReady(event types.CaptionsReadyEvent) error {
+// PublishStartCensor hands the finished captions to the censor service
+func (p *Producer) PublishStartCensor(event types.CaptionsReadyEvent) error {
 	return p.publishWithRetry("startCensor", event, 3)
 }
 
+// PublishCaptionsReady tells the transcoder the VTT is in S3, so it can be
+// packaged as a subtitle rendition
+func (p *Producer) PublishCaptionsReady(event types.CaptionsReadyEvent) error {
+	return p.publishWithRetry("captionsReady", event, 3)
+}
+
 // publishWithRetry publishes a message with retry logic
 func (p *Producer) publishWithRetry(topic string, payload interface{}, maxRetries int) error {
 	var lastErr error
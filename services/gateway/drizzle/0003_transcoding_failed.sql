@@ -0,0 +1,2 @@
+ALTER TABLE "videos" ADD COLUMN "transcodingFailed" boolean DEFAULT false;--> statement-breakpoint
+ALTER TABLE "videos" ADD COLUMN "failureReason" varchar(64) DEFAULT '';
\ No newline at end of file
@@ -21,6 +21,8 @@ export const videosTable = pgTable("videos", {
   transcodingFinished: boolean("transcodingFinished").default(false),
   captionsFinished: boolean("captionsFinished").default(false),
   censorFinished: boolean("censorFinished").default(false),
+  transcodingFailed: boolean("transcodingFailed").default(false),
+  failureReason: varchar({ length: 64 }).$type<string>().default(""),
   createdAt: timestamp().notNull().defaultNow().$type<Date>(),
   updatedAt: timestamp().notNull().defaultNow().$type<Date>(),
 });
@@ -4,11 +4,13 @@ import type {
   censorUpdateMessage,
   captionsUpdateMessage,
   transcoderUpdateMessage,
+  transcoderFailedMessage,
   packagingUpdateMessage,
 } from "../types/rabbit";
 import censorMessageHandler, {
   captionsMessageHandler,
   transcoderMessageHandler,
+  transcoderFailedMessageHandler,
 } from "./handlers";
 import {
   RABBITMQ_URL,
@@ -115,6 +117,10 @@ async function processMessage(messageData: any): Promise<void> {
     const transcoderMessage: transcoderUpdateMessage = messageData;
     const result = await transcoderMessageHandler(transcoderMessage);
     console.log("Transcode handler result:", result);
+  } else if (phase == "failed") {
+    console.log("Handling transcode failure message");
+    const failedMessage: transcoderFailedMessage = messageData;
+    await transcoderFailedMessageHandler(failedMessage);
   } else {
     console.warn(`⚠️ Unknown message type received:`, messageData);
   }
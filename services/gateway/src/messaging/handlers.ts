@@ -2,6 +2,7 @@ import type {
   censorUpdateMessage,
   captionsUpdateMessage,
   transcoderUpdateMessage,
+  transcoderFailedMessage,
 } from "../types/rabbit";
 import { DB, withDBRetry } from "../db/dbSetup";
 import { videosTable } from "../db/schema";
@@ -134,3 +135,25 @@ export async function transcoderMessageHandler(
 
   return result[0];
 }
+
+// The original stays in place (the transcoder tags it), so nothing is deleted
+export async function transcoderFailedMessageHandler(
+  message: transcoderFailedMessage
+) {
+  console.log(
+    `❌ Transcoding failed for ${message.VideoId}: ${message.FailureReason} ${message.FailureDetail ?? ""}`
+  );
+
+  const result = await withDBRetry(() =>
+    DB.update(videosTable)
+      .set({
+        transcodingFailed: true,
+        failureReason: message.FailureReason,
+        updatedAt: new Date(),
+      })
+      .where(eq(videosTable.id, message.VideoId))
+      .returning()
+  );
+
+  return result[0];
+}
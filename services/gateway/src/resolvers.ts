@@ -16,6 +16,8 @@ export const resolvers: Resolvers = {
           transcodingFinished: video.transcodingFinished,
           captionsFinished: video.captionsFinished,
           censorFinished: video.censorFinished,
+          transcodingFailed: video.transcodingFailed,
+          failureReason: video.failureReason,
           s3Key: video.s3Key,
           bucketName: video.bucketName,
           captionsKey: video.captionsKey,
@@ -45,6 +47,8 @@ export const resolvers: Resolvers = {
           transcodingFinished: video.transcodingFinished,
           captionsFinished: video.captionsFinished,
           censorFinished: video.censorFinished,
+          transcodingFailed: video.transcodingFailed,
+          failureReason: video.failureReason,
           s3Key: video.s3Key,
           bucketName: video.bucketName,
           captionsKey: video.captionsKey,
@@ -117,6 +121,8 @@ export const resolvers: Resolvers = {
             transcodingFinished: result.videoDetailsInDB.transcodingFinished,
             captionsFinished: result.videoDetailsInDB.captionsFinished,
             censorFinished: result.videoDetailsInDB.censorFinished,
+            transcodingFailed: result.videoDetailsInDB.transcodingFailed,
+            failureReason: result.videoDetailsInDB.failureReason,
             s3Key: result.videoDetailsInDB.s3Key,
             bucketName: result.videoDetailsInDB.bucketName,
             captionsKey: result.videoDetailsInDB.captionsKey,
@@ -168,6 +174,8 @@ export const resolvers: Resolvers = {
     transcodingFinished: (parent) => parent.transcodingFinished,
     captionsFinished: (parent) => parent.captionsFinished,
     censorFinished: (parent) => parent.censorFinished,
+    transcodingFailed: (parent) => parent.transcodingFailed,
+    failureReason: (parent) => parent.failureReason,
     s3Key: (parent) => parent.s3Key,
     bucketName: (parent) => parent.bucketName,
     captionsKey: (parent) => parent.captionsKey,
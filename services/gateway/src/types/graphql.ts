@@ -40,6 +40,8 @@ export type Video = {
   transcodingFinished?: Maybe<Scalars["Boolean"]>;
   captionsFinished?: Maybe<Scalars["Boolean"]>;
   censorFinished?: Maybe<Scalars["Boolean"]>;
+  transcodingFailed?: Maybe<Scalars["Boolean"]>;
+  failureReason?: Maybe<Scalars["String"]>;
   s3Key?: Maybe<Scalars["String"]>;
   bucketName?: Maybe<Scalars["String"]>;
   captionsKey?: Maybe<Scalars["String"]>;
@@ -297,6 +299,16 @@ export type VideoResolvers<
     ParentType,
     ContextType
   >;
+  transcodingFailed?: Resolver<
+    Maybe<ResolversTypes["Boolean"]>,
+    ParentType,
+    ContextType
+  >;
+  failureReason?: Resolver<
+    Maybe<ResolversTypes["String"]>,
+    ParentType,
+    ContextType
+  >;
   s3Key?: Resolver<Maybe<ResolversTypes["String"]>, ParentType, ContextType>;
   bucketName?: Resolver<
     Maybe<ResolversTypes["String"]>,
@@ -496,6 +508,18 @@ export interface Loaders<
       {},
       TContext
     >;
+    transcodingFailed?: LoaderResolver<
+      Maybe<Scalars["Boolean"]>,
+      Video,
+      {},
+      TContext
+    >;
+    failureReason?: LoaderResolver<
+      Maybe<Scalars["String"]>,
+      Video,
+      {},
+      TContext
+    >;
     s3Key?: LoaderResolver<Maybe<Scalars["String"]>, Video, {}, TContext>;
     bucketName?: LoaderResolver<Maybe<Scalars["String"]>, Video, {}, TContext>;
     captionsKey?: LoaderResolver<Maybe<Scalars["String"]>, Video, {}, TContext>;
@@ -18,6 +18,12 @@ export interface transcoderUpdateMessage extends serverUpdateMessage {
   VideoDuration: number;
 }
 
+// Sent instead of the transcode update when the transcoder gives up on a video
+export interface transcoderFailedMessage extends serverUpdateMessage {
+  FailureReason: string;
+  FailureDetail: string;
+}
+
 export interface packagingUpdateMessage extends serverUpdateMessage {
   ManifestKey: string;
   DashKey: string;
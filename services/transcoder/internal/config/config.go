@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/viper"
 	"github.com/subosito/gotenv"
@@ -24,6 +25,53 @@ type Config struct {
 	AWSRegion   string
 	// Path to the ffmpeg binary
 	FfmpegPath  string
+
+	// Path to the YAML/JSON encoding profiles file (empty uses the built-in ladder)
+	ProfilesPath string
+	// Profile used when a request doesn't name one (empty uses the file's default)
+	DefaultProfile string
+
+	// Maximum number of ffmpeg processes running at the same time, across all videos
+	MaxParallelEncodes int
+	// Threads given to each ffmpeg encode (0 lets ffmpeg pick)
+	FfmpegThreads int
+
+	// Seconds between two seek-bar preview tiles (0 disables storyboards)
+	StoryboardInterval float64
+	// Image format of the storyboard sprite sheets, jpg or webp
+	StoryboardFormat string
+
+	// Longest accepted upload in seconds (0 disables the limit)
+	MaxVideoDuration float64
+	// Longest accepted edge of an upload in pixels (0 disables the limit)
+	MaxVideoDimension int
+	// Comma-separated ffprobe codec and container names accepted (empty accepts all)
+	AllowedVideoCodecs []string
+	AllowedContainers []string
+	// Prefix rejected uploads are copied to
+	QuarantinePrefix string
+	// Prefix the watermark images requests name must be kept under
+	OverlayPrefix string
+
+	// Two-pass EBU R128 loudness normalization of every audio track
+	LoudnormEnabled bool
+	// Integrated loudness target in LUFS, true peak ceiling in dBTP and loudness range in LU
+	LoudnormTarget float64
+	LoudnormTruePeak float64
+	LoudnormRange float64
+
+	// AES-128 encryption of every HLS segment
+	HLSEncryption bool
+	// Key delivery URL written to the playlists, with {videoId} in it
+	HLSKeyURL string
+	// Where the per-video content keys are kept, s3 or file
+	HLSKeyStore string
+	// Directory the content keys are kept in with the file store; shared storage when running more than one replica
+	HLSKeyDir string
+	// Bucket prefix the content keys are kept under with the s3 store; must not be public
+	HLSKeyPrefix string
+	// KMS key the content keys are encrypted with at rest (empty uses SSE-S3)
+	HLSKeyKMSKeyID string
 }
 
 // LoadConfig reads configuration from environment variables (via Viper)
@@ -37,6 +85,24 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("FFMPEG_PATH", "ffmpeg")
 	viper.SetDefault("ORIGINAL_PREFIX", "uploads/originals")
 	viper.SetDefault("TRANSCODED_PREFIX", "transcoded")
+	viper.SetDefault("MAX_PARALLEL_ENCODES", 2)
+	viper.SetDefault("FFMPEG_THREADS", 0)
+	viper.SetDefault("STORYBOARD_INTERVAL", 5)
+	viper.SetDefault("STORYBOARD_FORMAT", "jpg")
+	viper.SetDefault("MAX_VIDEO_DURATION", 4*60*60)
+	viper.SetDefault("MAX_VIDEO_DIMENSION", 7680)
+	viper.SetDefault("ALLOWED_VIDEO_CODECS", "h264,hevc,vp8,vp9,av1,mpeg4,mpeg2video,prores")
+	viper.SetDefault("ALLOWED_CONTAINERS", "mov,mp4,matroska,webm,avi,mpegts")
+	viper.SetDefault("QUARANTINE_PREFIX", "quarantine")
+	viper.SetDefault("OVERLAY_PREFIX", "overlays")
+	viper.SetDefault("LOUDNORM_ENABLED", false)
+	viper.SetDefault("LOUDNORM_TARGET", -16)
+	viper.SetDefault("LOUDNORM_TRUE_PEAK", -1.5)
+	viper.SetDefault("LOUDNORM_RANGE", 11)
+	viper.SetDefault("HLS_ENCRYPTION", false)
+	viper.SetDefault("HLS_KEY_STORE", "s3")
+	viper.SetDefault("HLS_KEY_DIR", "/var/lib/transcoder/keys")
+	viper.SetDefault("HLS_KEY_PREFIX", "keys")
 
 	// Required keys
 	required := []string{
@@ -57,6 +123,91 @@ func LoadConfig() (*Config, error) {
 		TranscodedPrefix: viper.GetString("TRANSCODED_PREFIX"),
 		AWSRegion:    viper.GetString("AWS_REGION"),
 		FfmpegPath:   viper.GetString("FFMPEG_PATH"),
+		ProfilesPath: viper.GetString("ENCODING_PROFILES_PATH"),
+		DefaultProfile: viper.GetString("DEFAULT_ENCODING_PROFILE"),
+		MaxParallelEncodes: viper.GetInt("MAX_PARALLEL_ENCODES"),
+		FfmpegThreads: viper.GetInt("FFMPEG_THREADS"),
+		StoryboardInterval: viper.GetFloat64("STORYBOARD_INTERVAL"),
+		StoryboardFormat: viper.GetString("STORYBOARD_FORMAT"),
+		MaxVideoDuration: viper.GetFloat64("MAX_VIDEO_DURATION"),
+		MaxVideoDimension: viper.GetInt("MAX_VIDEO_DIMENSION"),
+		AllowedVideoCodecs: splitList(viper.GetString("ALLOWED_VIDEO_CODECS")),
+		AllowedContainers: splitList(viper.GetString("ALLOWED_CONTAINERS")),
+		QuarantinePrefix: viper.GetString("QUARANTINE_PREFIX"),
+		OverlayPrefix: viper.GetString("OVERLAY_PREFIX"),
+		LoudnormEnabled: viper.GetBool("LOUDNORM_ENABLED"),
+		LoudnormTarget: viper.GetFloat64("LOUDNORM_TARGET"),
+		LoudnormTruePeak: viper.GetFloat64("LOUDNORM_TRUE_PEAK"),
+		LoudnormRange: viper.GetFloat64("LOUDNORM_RANGE"),
+		HLSEncryption: viper.GetBool("HLS_ENCRYPTION"),
+		HLSKeyURL: viper.GetString("HLS_KEY_URL"),
+		HLSKeyStore: viper.GetString("HLS_KEY_STORE"),
+		HLSKeyDir: viper.GetString("HLS_KEY_DIR"),
+		HLSKeyPrefix: viper.GetString("HLS_KEY_PREFIX"),
+		HLSKeyKMSKeyID: viper.GetString("HLS_KEY_KMS_KEY_ID"),
+	}
+	if cfg.MaxParallelEncodes < 1 {
+		return nil, fmt.Errorf("MAX_PARALLEL_ENCODES must be at least 1, got %d", cfg.MaxParallelEncodes)
+	}
+	if cfg.FfmpegThreads < 0 {
+		return nil, fmt.Errorf("FFMPEG_THREADS must not be negative, got %d", cfg.FfmpegThreads)
+	}
+	if cfg.StoryboardInterval < 0 {
+		return nil, fmt.Errorf("STORYBOARD_INTERVAL must not be negative, got %g", cfg.StoryboardInterval)
+	}
+	if cfg.StoryboardFormat != "jpg" && cfg.StoryboardFormat != "webp" {
+		return nil, fmt.Errorf("STORYBOARD_FORMAT must be jpg or webp, got %q", cfg.StoryboardFormat)
+	}
+	if cfg.MaxVideoDuration < 0 || cfg.MaxVideoDimension < 0 {
+		return nil, fmt.Errorf("MAX_VIDEO_DURATION and MAX_VIDEO_DIMENSION must not be negative")
+	}
+	// the ranges ffmpeg's loudnorm filter accepts
+	if cfg.LoudnormTarget < -70 || cfg.LoudnormTarget > -5 {
+		return nil, fmt.Errorf("LOUDNORM_TARGET must be between -70 and -5 LUFS, got %g", cfg.LoudnormTarget)
+	}
+	if cfg.LoudnormTruePeak < -9 || cfg.LoudnormTruePeak > 0 {
+		return nil, fmt.Errorf("LOUDNORM_TRUE_PEAK must be between -9 and 0 dBTP, got %g", cfg.LoudnormTruePeak)
+	}
+	if cfg.LoudnormRange < 1 || cfg.LoudnormRange > 50 {
+		return nil, fmt.Errorf("LOUDNORM_RANGE must be between 1 and 50 LU, got %g", cfg.LoudnormRange)
+	}
+	if strings.Trim(cfg.OverlayPrefix, "/") == "" {
+		return nil, fmt.Errorf("OVERLAY_PREFIX must not be empty, it keeps watermarks from naming any object of the bucket")
+	}
+	if cfg.HLSEncryption {
+		if !strings.Contains(cfg.HLSKeyURL, "{videoId}") {
+			return nil, fmt.Errorf("HLS_KEY_URL must contain {videoId} when HLS_ENCRYPTION is on, got %q", cfg.HLSKeyURL)
+		}
+		// it ends up in a quoted playlist attribute
+		if strings.ContainsAny(cfg.HLSKeyURL, "\"\r\n") {
+			return nil, fmt.Errorf("HLS_KEY_URL must not contain quotes or line breaks")
+		}
+		switch cfg.HLSKeyStore {
+		case "s3":
+			// the transcoded prefix is served publicly, which would hand out the keys
+			keyPrefix := strings.Trim(cfg.HLSKeyPrefix, "/")
+			transcodedPrefix := strings.Trim(cfg.TranscodedPrefix, "/")
+			if keyPrefix == "" || transcodedPrefix == "" || keyPrefix == transcodedPrefix || strings.HasPrefix(keyPrefix, transcodedPrefix+"/") {
+				return nil, fmt.Errorf("HLS_KEY_PREFIX must be a private prefix outside TRANSCODED_PREFIX, got %q", cfg.HLSKeyPrefix)
+			}
+		case "file":
+			if cfg.HLSKeyDir == "" {
+				return nil, fmt.Errorf("HLS_KEY_DIR is required with HLS_KEY_STORE=file")
+			}
+		default:
+			return nil, fmt.Errorf("HLS_KEY_STORE must be s3 or file, got %q", cfg.HLSKeyStore)
+		}
 	}
 	return cfg, nil
 }
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
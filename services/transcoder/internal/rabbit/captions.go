@@ -0,0 +1,112 @@
+package rabbit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/processor"
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// CaptionsConsumer listens for finished captions and attaches them to the
+// video's HLS output as a subtitle rendition.
+type CaptionsConsumer struct {
+	channel *amqp.Channel
+	queue   string
+	logger  *zap.Logger
+}
+
+func NewCaptionsConsumer(channel *amqp.Channel, logger *zap.Logger) (*CaptionsConsumer, error) {
+	queueName := "transcoderCaptionsReady"
+	exchangeName := "newVideoUploaded"
+	routingKey := "captionsReady" // published by the captions service once the VTT is in S3
+
+	// Declare the queue
+	if _, err := channel.QueueDeclare(
+		queueName,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	); err != nil {
+		return nil, err
+	}
+
+	// Bind the queue to the exchange with the routing key
+	if err := channel.QueueBind(
+		queueName,
+		routingKey,
+		exchangeName,
+		false, // no-wait
+		nil,   // arguments
+	); err != nil {
+		return nil, fmt.Errorf("queue bind: %w", err)
+	}
+
+	return &CaptionsConsumer{channel: channel, queue: queueName, logger: logger}, nil
+}
+
+func (c *CaptionsConsumer) Consume(ctx context.Context, bucketName string, transcodedPrefix string, s3Client *s3.S3) error {
+	msgs, err := c.channel.Consume(
+		c.queue,
+		"",    // consumer tag
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return nil // channel closed
+			}
+			// captions are cheap to package, so handle them one at a time
+			c.handle(ctx, d, bucketName, transcodedPrefix, s3Client)
+		}
+	}
+}
+
+func (c *CaptionsConsumer) handle(ctx context.Context, d amqp.Delivery, bucketName string, transcodedPrefix string, s3Client *s3.S3) {
+	defer func() {
+		// Recover from panic and nack the message
+		if r := recover(); r != nil {
+			c.logger.Error("panic in captions handle", zap.Any("error", r))
+			d.Nack(false, true)
+		}
+	}()
+
+	var event types.CaptionsReadyEvent
+	if err := json.Unmarshal(d.Body, &event); err != nil {
+		c.logger.Error("invalid captions message", zap.Error(err), zap.ByteString("body", d.Body))
+		d.Nack(false, false) // discard if bad message
+		return
+	}
+	if event.VideoId == "" || event.VTTKey == "" {
+		c.logger.Warn("captions message without video or VTT key", zap.ByteString("body", d.Body))
+		d.Ack(false)
+		return
+	}
+
+	c.logger.Info("received captions", zap.String("videoId", event.VideoId), zap.String("vttKey", event.VTTKey))
+
+	if err := processor.AttachCaptions(ctx, event, bucketName, transcodedPrefix, s3Client, c.logger); err != nil {
+		c.logger.Error("attaching captions failed", zap.Error(err), zap.String("videoId", event.VideoId))
+		d.Nack(false, true) // requeue for retry
+		return
+	}
+
+	d.Ack(false)
+}
@@ -3,6 +3,7 @@ package rabbit
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/GoyalIshaan/vidSmith/services/transcoder/processor"
@@ -15,6 +16,17 @@ import (
 
 const prefetchCount = 5
 
+// transcodeRoutingKey is what the gateway publishes transcode requests with.
+const transcodeRoutingKey = "videoUploaded"
+
+// maxTranscodeAttempts is how many times a request is tried before it is
+// reported as failed, so a video that always breaks the transcode can't
+// cycle through the queue forever.
+const maxTranscodeAttempts = 5
+
+// attemptHeader counts the earlier attempts of a republished request.
+const attemptHeader = "x-transcode-attempt"
+
 type Consumer struct {
 	channel *amqp.Channel
 	queue   string
@@ -26,7 +38,7 @@ func NewConsumer(channel *amqp.Channel, logger *zap.Logger) (*Consumer, error) {
 	queueName := "transcodeRequest"
 	exchangeName := "newVideoUploaded"
 	exchangeType := "topic"
-	routingKey := "videoUploaded"
+	routingKey := transcodeRoutingKey
 
 	// Declare the exchange (same as gateway)
 	if err := channel.ExchangeDeclare(
@@ -72,7 +84,7 @@ func NewConsumer(channel *amqp.Channel, logger *zap.Logger) (*Consumer, error) {
 	return &Consumer{channel: channel, queue: queueName, logger: logger, exchange: exchangeName}, nil
 }
 
-func (c *Consumer) Consume(ctx context.Context, bucketName string, transcodedPrefix string, manifestPrefix string, s3Client *s3.S3, awsSession *session.Session, producer *Producer) error {
+func (c *Consumer) Consume(ctx context.Context, bucketName string, transcodedPrefix string, manifestPrefix string, opts processor.Options, s3Client *s3.S3, awsSession *session.Session, producer *Producer) error {
 	msgs, err := c.channel.Consume(
 		c.queue,
 		"",    // consumer tag
@@ -104,18 +116,18 @@ func (c *Consumer) Consume(ctx context.Context, bucketName string, transcodedPre
 
 			go func(delivery amqp.Delivery) {
 				defer func() { <-semaphore }() // Release semaphore slot
-				c.handle(ctx, delivery, bucketName, transcodedPrefix, s3Client, awsSession, producer)
+				c.handle(ctx, delivery, bucketName, transcodedPrefix, opts, s3Client, awsSession, producer)
 			}(d)
 		}
 	}
 }
 
-func (c *Consumer) handle(ctx context.Context, d amqp.Delivery, bucketName string, transcodedPrefix string, s3Client *s3.S3, awsSession *session.Session, producer *Producer) {
+func (c *Consumer) handle(ctx context.Context, d amqp.Delivery, bucketName string, transcodedPrefix string, opts processor.Options, s3Client *s3.S3, awsSession *session.Session, producer *Producer) {
 	defer func() {
 		// Recover from panic and nack the message
 		if r := recover(); r != nil {
 			c.logger.Error("panic in handle", zap.Any("error", r))
-			d.Nack(false, true)
+			c.retry(d, fmt.Errorf("panic: %v", r), producer)
 		}
 	}()
 
@@ -126,15 +138,33 @@ func (c *Consumer) handle(ctx context.Context, d amqp.Delivery, bucketName strin
 		return
 	}
 
-	c.logger.Info("received transcode request", zap.String("videoId", req.VideoId), zap.String("s3Key", req.S3Key))
+	c.logger.Info("received transcode request", zap.String("videoId", req.VideoId), zap.String("s3Key", req.S3Key), zap.String("profile", req.Profile))
 
 	// Use the existing s3Client's session instead of creating a new one
 	// invoking the transcoding service
 
-	updateVideoStatusEvent, err := processor.Process(ctx, req, bucketName, transcodedPrefix, s3Client, awsSession, c.logger)
+	reportProgress := func(event types.TranscodeProgressEvent) {
+		if err := producer.PublishTranscodeProgress(event); err != nil {
+			c.logger.Warn("failed to publish progress", zap.Error(err), zap.String("videoId", req.VideoId))
+		}
+	}
+
+	updateVideoStatusEvent, err := processor.Process(ctx, req, bucketName, transcodedPrefix, opts, s3Client, awsSession, reportProgress, c.logger)
+	var invalid *processor.ValidationError
+	if errors.As(err, &invalid) {
+		c.logger.Error("rejected upload", zap.Error(err), zap.String("videoId", req.VideoId), zap.String("reason", invalid.Reason))
+		d.Ack(false) // retrying can't fix the upload, so report it instead
+		producer.PublishUpdateVideoStatus(types.UpdateVideoStatusEvent{
+			VideoId:       req.VideoId,
+			Phase:         "failed",
+			FailureReason: invalid.Reason,
+			FailureDetail: invalid.Detail,
+		})
+		return
+	}
 	if err != nil {
 		c.logger.Error("transcoding failed", zap.Error(err))
-		d.Nack(false, true) // requeue for retry
+		c.retry(d, err, producer)
 		return
 	}
 
@@ -144,3 +174,43 @@ func (c *Consumer) handle(ctx context.Context, d amqp.Delivery, bucketName strin
 
 	c.logger.Info("transcode request completed", zap.String("videoId", req.VideoId))
 }
+
+// retry puts a failed request back on the queue with its attempt counted,
+// or reports the video as failed once maxTranscodeAttempts is reached. A
+// plain requeue would lose the count, as the broker doesn't keep one.
+func (c *Consumer) retry(d amqp.Delivery, err error, producer *Producer) {
+	attempt := deliveryAttempt(d) + 1
+	if attempt >= maxTranscodeAttempts {
+		var req types.TranscodeRequest
+		json.Unmarshal(d.Body, &req)
+		c.logger.Error("giving up on transcode request", zap.String("videoId", req.VideoId), zap.Int("attempts", attempt), zap.Error(err))
+		d.Ack(false)
+		producer.PublishUpdateVideoStatus(types.UpdateVideoStatusEvent{
+			VideoId:       req.VideoId,
+			Phase:         "failed",
+			FailureReason: processor.ReasonRetriesExhausted,
+			FailureDetail: err.Error(),
+		})
+		return
+	}
+
+	if pubErr := producer.RepublishTranscodeRequest(d.Body, attempt); pubErr != nil {
+		c.logger.Error("failed to republish transcode request", zap.Error(pubErr))
+		d.Nack(false, true) // requeue for retry, uncounted
+		return
+	}
+	d.Ack(false)
+}
+
+// deliveryAttempt returns how many times the request was tried before.
+func deliveryAttempt(d amqp.Delivery) int {
+	switch n := d.Headers[attemptHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
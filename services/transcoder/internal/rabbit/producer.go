@@ -63,12 +63,25 @@ func (p *Producer) PublishUpdateVideoStatus(event types.UpdateVideoStatusEvent)
 	return p.publishWithRetry("updateVideoStatus", event, 3)
 }
 
+// PublishTranscodeProgress publishes a progress update. Progress is
+// superseded by the next update, so it is neither retried nor required to
+// reach a queue.
+func (p *Producer) PublishTranscodeProgress(event types.TranscodeProgressEvent) error {
+	return p.publish("transcodeProgress", event, false)
+}
+
+// RepublishTranscodeRequest puts a transcode request that failed back on its
+// queue, recording in the attemptHeader how many times it has been tried.
+func (p *Producer) RepublishTranscodeRequest(body []byte, attempt int) error {
+	return p.publishBody(transcodeRoutingKey, body, amqp.Table{attemptHeader: int32(attempt)}, true)
+}
+
 // publishWithRetry publishes a message with retry logic
 func (p *Producer) publishWithRetry(topic string, payload interface{}, maxRetries int) error {
 	var lastErr error
 	
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		lastErr = p.publish(topic, payload)
+		lastErr = p.publish(topic, payload, true)
 		if lastErr == nil {
 			return nil // Success
 		}
@@ -89,14 +102,19 @@ func (p *Producer) publishWithRetry(topic string, payload interface{}, maxRetrie
 }
 
 // publish publishes a single message to RabbitMQ
-func (p *Producer) publish(topic string, payload interface{}) error {
+func (p *Producer) publish(topic string, payload interface{}, mandatory bool) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		p.logger.Error("failed to marshal payload", zap.Error(err))
 		return fmt.Errorf("marshal payload: %w", err)
 	}
+	return p.publishBody(topic, body, nil, mandatory)
+}
 
+// publishBody publishes an already encoded JSON message
+func (p *Producer) publishBody(topic string, body []byte, headers amqp.Table, mandatory bool) error {
 	pub := amqp.Publishing{
+		Headers:     headers,
 		ContentType: "application/json",
 		MessageId:   uuid.New().String(),
 		Timestamp:   time.Now(),
@@ -106,10 +124,10 @@ func (p *Producer) publish(topic string, payload interface{}) error {
 	p.messageMutex.Lock()
 	defer p.messageMutex.Unlock()
 
-	if err = p.channel.Publish(
+	if err := p.channel.Publish(
 		p.exchange, // exchange
 		topic,      // routing key
-		true,      // mandatory
+		mandatory,  // mandatory
 		false,      // immediate
 		pub,
 	); 
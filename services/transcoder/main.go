@@ -9,6 +9,7 @@ import (
 
 	"github.com/GoyalIshaan/vidSmith/services/transcoder/internal/config"
 	"github.com/GoyalIshaan/vidSmith/services/transcoder/internal/rabbit"
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/processor"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -25,11 +26,55 @@ func main() {
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
 
+	profiles, err := processor.LoadProfiles(config.ProfilesPath, config.DefaultProfile)
+	if err != nil {
+		panic("encoding profiles: " + err.Error())
+	}
+
 	session := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(config.AWSRegion),
 	}))
 	s3Client := s3.New(session)
 
+	processorOptions := processor.Options{
+		Profiles:      profiles,
+		Ffmpeg:        processor.NewFfmpegSlots(config.MaxParallelEncodes),
+		FfmpegThreads: config.FfmpegThreads,
+		Storyboard: processor.StoryboardOptions{
+			Interval: config.StoryboardInterval,
+			Format:   config.StoryboardFormat,
+		},
+		Limits: processor.Limits{
+			MaxDuration:        config.MaxVideoDuration,
+			MaxDimension:       config.MaxVideoDimension,
+			AllowedVideoCodecs: config.AllowedVideoCodecs,
+			AllowedContainers:  config.AllowedContainers,
+		},
+		QuarantinePrefix: config.QuarantinePrefix,
+		OverlayPrefix:    config.OverlayPrefix,
+		Loudness: processor.LoudnessOptions{
+			Enabled:  config.LoudnormEnabled,
+			Target:   config.LoudnormTarget,
+			TruePeak: config.LoudnormTruePeak,
+			Range:    config.LoudnormRange,
+		},
+	}
+	if config.HLSEncryption {
+		var keys processor.KeyProvider
+		switch config.HLSKeyStore {
+		case "file":
+			keys, err = processor.NewFileKeyProvider(config.HLSKeyDir)
+			if err != nil {
+				panic("content keys: " + err.Error())
+			}
+			logger.Warn("content keys are kept on local disk; HLS_KEY_DIR must be shared by every replica", zap.String("dir", config.HLSKeyDir))
+		default:
+			// keys live in the bucket so every replica encrypts a video with the same one
+			keys = processor.NewS3KeyProvider(s3Client, config.BucketName, config.HLSKeyPrefix, config.HLSKeyKMSKeyID)
+		}
+		processorOptions.Encryption = processor.EncryptionOptions{Keys: keys, KeyURL: config.HLSKeyURL}
+	}
+
 	rabbitConnection, err := amqp.Dial(config.AmqpURL)
 	if err != nil {
 		panic("failed to connect to RabbitMQ: " + err.Error())
@@ -47,6 +92,11 @@ func main() {
 		panic("failed to create RabbitMQ consumer: " + err.Error())
 	}
 
+	captionsConsumer, err := rabbit.NewCaptionsConsumer(rabbitChannel, logger)
+	if err != nil {
+		panic("failed to create RabbitMQ captions consumer: " + err.Error())
+	}
+
 	rabbitProducer, err := rabbit.NewProducer(rabbitChannel, logger)
 	if err != nil {
 		panic("failed to create RabbitMQ producer: " + err.Error())
@@ -85,12 +135,19 @@ func main() {
 	
 	// Start consumer in a goroutine
 	go func() {
-		err := rabbitConsumer.Consume(ctx, config.BucketName, config.TranscodedPrefix, config.ManifestPrefix, s3Client, session, rabbitProducer)
+		err := rabbitConsumer.Consume(ctx, config.BucketName, config.TranscodedPrefix, config.ManifestPrefix, processorOptions, s3Client, session, rabbitProducer)
 		if err != nil {
 			logger.Error("consumer error", zap.Error(err))
 		}
 	}()
 
+	go func() {
+		err := captionsConsumer.Consume(ctx, config.BucketName, config.TranscodedPrefix, s3Client)
+		if err != nil {
+			logger.Error("captions consumer error", zap.Error(err))
+		}
+	}()
+
 	// Wait for interrupt signal
 	<-sigs
 	logger.Info("Received shutdown signal, gracefully shutting down...")
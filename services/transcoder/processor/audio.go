@@ -0,0 +1,130 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// audioSpec defines one audio rendition. Every audio stream of the source gets
+// its own rendition, shared by all video renditions through the HLS audio group.
+type audioSpec struct {
+	// StreamIndex selects the source stream as 0:a:<StreamIndex>
+	StreamIndex int
+	Bitrate     string
+	Channels    int
+	// Language is the RFC 5646 tag advertised in LANGUAGE, "" if unknown
+	Language       string
+	Label          string
+	Default        bool
+	Commentary     bool
+	VisualImpaired bool
+	// Loudnorm normalizes the loudness of the track; nil leaves it as it is
+	Loudnorm *loudnorm
+}
+
+// renditionName is the directory and S3 key segment of the audio rendition.
+func (a audioSpec) renditionName() string {
+	return fmt.Sprintf("audio_%d", a.StreamIndex)
+}
+
+// planAudioRenditions turns the source's audio streams into audio renditions.
+// Exactly one of them is marked default: the first stream flagged default that
+// isn't commentary, falling back to the first main-program stream.
+func planAudioRenditions(streams []audioStream, profile encodingProfile) []audioSpec {
+	settings := profile.audio()
+
+	specs := make([]audioSpec, 0, len(streams))
+	for i, stream := range streams {
+		spec := settings
+		spec.StreamIndex = i
+		spec.Language = languageTag(stream.Language)
+		spec.Label = audioLabel(stream, i)
+		spec.Commentary = stream.Commentary
+		spec.VisualImpaired = stream.VisualImpaired
+		specs = append(specs, spec)
+	}
+
+	defaultIndex := -1
+	for i, stream := range streams {
+		if stream.Default && !isSecondaryAudio(stream) {
+			defaultIndex = i
+			break
+		}
+	}
+	if defaultIndex < 0 {
+		for i, stream := range streams {
+			if !isSecondaryAudio(stream) {
+				defaultIndex = i
+				break
+			}
+		}
+	}
+	if defaultIndex < 0 && len(specs) > 0 {
+		defaultIndex = 0
+	}
+	if defaultIndex >= 0 {
+		specs[defaultIndex].Default = true
+	}
+
+	return specs
+}
+
+// isSecondaryAudio reports streams that shouldn't be picked automatically.
+func isSecondaryAudio(stream audioStream) bool {
+	return stream.Commentary || stream.VisualImpaired
+}
+
+// audioLabel picks the NAME shown in player track menus.
+func audioLabel(stream audioStream, index int) string {
+	if stream.Title != "" {
+		return stream.Title
+	}
+
+	label := languageNames[stream.Language]
+	if label == "" {
+		label = fmt.Sprintf("Track %d", index+1)
+	}
+	switch {
+	case stream.Commentary:
+		label += " (Commentary)"
+	case stream.VisualImpaired:
+		label += " (Audio Description)"
+	}
+	return label
+}
+
+// languageTag converts the ISO 639-2 codes containers use into the shortest
+// RFC 5646 tag, e.g. "eng" -> "en". Unknown codes are passed through as-is,
+// which is still a valid tag.
+func languageTag(code string) string {
+	if tag, ok := iso639Tags[code]; ok {
+		return tag
+	}
+	return strings.ToLower(code)
+}
+
+// iso639Tags maps ISO 639-2 codes (both B and T forms) to ISO 639-1.
+var iso639Tags = map[string]string{
+	"ara": "ar", "ben": "bn", "chi": "zh", "zho": "zh", "cze": "cs", "ces": "cs",
+	"dan": "da", "dut": "nl", "nld": "nl", "eng": "en", "fin": "fi", "fre": "fr",
+	"fra": "fr", "ger": "de", "deu": "de", "gre": "el", "ell": "el", "heb": "he",
+	"hin": "hi", "hun": "hu", "ind": "id", "ita": "it", "jpn": "ja", "kor": "ko",
+	"may": "ms", "msa": "ms", "nor": "no", "per": "fa", "fas": "fa", "pol": "pl",
+	"por": "pt", "rum": "ro", "ron": "ro", "rus": "ru", "spa": "es", "swe": "sv",
+	"tam": "ta", "tel": "te", "tha": "th", "tur": "tr", "ukr": "uk", "urd": "ur",
+	"vie": "vi",
+}
+
+// languageNames gives a display name for the ISO 639-2 codes we know.
+var languageNames = map[string]string{
+	"ara": "Arabic", "ben": "Bengali", "chi": "Chinese", "zho": "Chinese",
+	"cze": "Czech", "ces": "Czech", "dan": "Danish", "dut": "Dutch", "nld": "Dutch",
+	"eng": "English", "fin": "Finnish", "fre": "French", "fra": "French",
+	"ger": "German", "deu": "German", "gre": "Greek", "ell": "Greek", "heb": "Hebrew",
+	"hin": "Hindi", "hun": "Hungarian", "ind": "Indonesian", "ita": "Italian",
+	"jpn": "Japanese", "kor": "Korean", "may": "Malay", "msa": "Malay",
+	"nor": "Norwegian", "per": "Persian", "fas": "Persian", "pol": "Polish",
+	"por": "Portuguese", "rum": "Romanian", "ron": "Romanian", "rus": "Russian",
+	"spa": "Spanish", "swe": "Swedish", "tam": "Tamil", "tel": "Telugu", "tha": "Thai",
+	"tur": "Turkish", "ukr": "Ukrainian", "urd": "Urdu", "vie": "Vietnamese",
+}
@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// checkpointVersion is bumped whenever renditionOutput changes shape, which
+// invalidates every checkpoint written before.
+const checkpointVersion = 3
+
+// checkpoint records the renditions of a video that are fully uploaded, so a
+// redelivered request only encodes what is missing.
+type checkpoint struct {
+	Version    int                        `json:"version"`
+	Renditions map[string]checkpointEntry `json:"renditions"`
+}
+
+type checkpointEntry struct {
+	// Fingerprint identifies the source and encode settings the rendition was
+	// made with; a changed profile or source makes the entry stale.
+	Fingerprint string          `json:"fingerprint"`
+	Output      renditionOutput `json:"output"`
+}
+
+// checkpointStore keeps a video's checkpoint in S3 next to its renditions.
+// It is safe for concurrent use by the encode pool.
+type checkpointStore struct {
+	mu       sync.Mutex
+	s3Client *s3.S3
+	bucket   string
+	key      string
+	data     checkpoint
+	logger   *zap.Logger
+}
+
+// loadCheckpoint reads the checkpoint of a video. A missing, unreadable or
+// outdated checkpoint starts empty rather than failing the transcode.
+func loadCheckpoint(ctx context.Context, s3Client *s3.S3, bucket, transcodedPrefix, videoID string, logger *zap.Logger) *checkpointStore {
+	store := &checkpointStore{
+		s3Client: s3Client,
+		bucket:   bucket,
+		key:      path.Join(transcodedPrefix, videoID, "checkpoint.json"),
+		data:     checkpoint{Version: checkpointVersion, Renditions: map[string]checkpointEntry{}},
+		logger:   logger,
+	}
+
+	raw, err := getObject(ctx, s3Client, bucket, store.key)
+	if isNotFound(err) {
+		return store
+	}
+	if err != nil {
+		logger.Warn("could not read checkpoint, starting over", zap.Error(err))
+		return store
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(raw, &saved); err != nil || saved.Version != checkpointVersion || saved.Renditions == nil {
+		logger.Warn("ignoring invalid checkpoint", zap.Error(err), zap.Int("version", saved.Version))
+		return store
+	}
+
+	store.data = saved
+	logger.Info("checkpoint loaded", zap.Int("renditions", len(saved.Renditions)))
+	return store
+}
+
+// completed returns the recorded output of a rendition if it was finished
+// with the same fingerprint.
+func (c *checkpointStore) completed(name, fingerprint string) (renditionOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.data.Renditions[name]
+	if !ok || entry.Fingerprint != fingerprint {
+		return renditionOutput{}, false
+	}
+	return entry.Output, true
+}
+
+// record marks a rendition complete and saves the checkpoint. Failing to save
+// only costs a re-encode on redelivery, so it is logged, not returned.
+func (c *checkpointStore) record(ctx context.Context, name, fingerprint string, output renditionOutput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data.Renditions[name] = checkpointEntry{Fingerprint: fingerprint, Output: output}
+	if err := c.saveLocked(ctx); err != nil {
+		c.logger.Warn("could not save checkpoint", zap.String("rendition", name), zap.Error(err))
+	}
+}
+
+// forget drops a rendition so the next attempt encodes it again, e.g. after
+// its uploaded output failed verification.
+func (c *checkpointStore) forget(ctx context.Context, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.data.Renditions[name]; !ok {
+		return
+	}
+	delete(c.data.Renditions, name)
+	if err := c.saveLocked(ctx); err != nil {
+		c.logger.Warn("could not save checkpoint", zap.String("rendition", name), zap.Error(err))
+	}
+}
+
+func (c *checkpointStore) saveLocked(ctx context.Context) error {
+	raw, err := json.Marshal(c.data)
+	if err != nil {
+		return err
+	}
+	_, err = c.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(c.key),
+		Body:         bytes.NewReader(raw),
+		ContentType:  aws.String("application/json"),
+		CacheControl: aws.String("no-store"),
+	})
+	return err
+}
+
+// jobFingerprint hashes what determines an encode's output: the source object
+// and the ffmpeg arguments, with the per-run staging path of the input masked.
+func jobFingerprint(job encodeJob, sourceKey, inputPath string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", sourceKey)
+	for _, arg := range job.Args {
+		if arg == inputPath {
+			arg = "<input>"
+		}
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,228 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// initSegmentCodecs builds an RFC 6381 CODECS value from the sample entries of
+// an fMP4 init segment, so playlists advertise the profile and level the
+// encoder actually produced instead of a guess.
+func initSegmentCodecs(initPath string) (string, error) {
+	data, err := os.ReadFile(initPath)
+	if err != nil {
+		return "", err
+	}
+
+	var codecs []string
+
+	video, err := videoCodecString(data)
+	if err != nil {
+		return "", err
+	}
+	if video != "" {
+		codecs = append(codecs, video)
+	}
+
+	if esds := findBox(data, "esds"); esds != nil {
+		audio, err := aacCodecString(esds)
+		if err != nil {
+			return "", err
+		}
+		codecs = append(codecs, audio)
+	}
+
+	if len(codecs) == 0 {
+		return "", fmt.Errorf("no supported decoder configuration found in %s", initPath)
+	}
+	return strings.Join(codecs, ","), nil
+}
+
+// videoCodecString reads the decoder configuration record of the video track,
+// returning "" when the init segment has no video.
+func videoCodecString(data []byte) (string, error) {
+	if avcC := findBox(data, "avcC"); avcC != nil {
+		// configurationVersion, AVCProfileIndication, profile_compatibility, AVCLevelIndication
+		if len(avcC) < 4 {
+			return "", fmt.Errorf("avcC box too short")
+		}
+		return fmt.Sprintf("avc1.%02X%02X%02X", avcC[1], avcC[2], avcC[3]), nil
+	}
+	if hvcC := findBox(data, "hvcC"); hvcC != nil {
+		return hevcCodecString(hvcC)
+	}
+	if av1C := findBox(data, "av1C"); av1C != nil {
+		return av1CodecString(av1C)
+	}
+	return "", nil
+}
+
+// hevcCodecString formats an hvcC record as ISO/IEC 14496-15 Annex E
+// describes, e.g. hvc1.1.6.L93.B0 for Main profile at level 3.1.
+func hevcCodecString(hvcC []byte) (string, error) {
+	// configurationVersion, profile byte, 4 compatibility bytes, 6 constraint bytes, level
+	if len(hvcC) < 13 {
+		return "", fmt.Errorf("hvcC box too short")
+	}
+	profileSpace := hvcC[1] >> 6
+	tier := "L"
+	if hvcC[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profileIDC := hvcC[1] & 0x1F
+	compatibility := bits.Reverse32(binary.BigEndian.Uint32(hvcC[2:6]))
+	level := hvcC[12]
+
+	codec := "hvc1."
+	if profileSpace > 0 {
+		codec += string(rune('A' + profileSpace - 1))
+	}
+	codec += fmt.Sprintf("%d.%X.%s%d", profileIDC, compatibility, tier, level)
+
+	// constraint bytes, with trailing zero bytes left out
+	constraints := hvcC[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		codec += fmt.Sprintf(".%X", b)
+	}
+	return codec, nil
+}
+
+// av1CodecString formats an av1C record as the AV1 ISOBMFF binding
+// describes, e.g. av01.0.08M.08 for 8-bit Main profile at level 4.0.
+func av1CodecString(av1C []byte) (string, error) {
+	// marker/version, seq_profile/seq_level_idx_0, tier/bit depth/chroma flags
+	if len(av1C) < 3 {
+		return "", fmt.Errorf("av1C box too short")
+	}
+	profile := av1C[1] >> 5
+	level := av1C[1] & 0x1F
+	tier := "M"
+	if av1C[2]&0x80 != 0 {
+		tier = "H"
+	}
+	bitDepth := 8
+	if av1C[2]&0x40 != 0 { // high_bitdepth
+		bitDepth = 10
+		if av1C[2]&0x20 != 0 { // twelve_bit
+			bitDepth = 12
+		}
+	}
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", profile, level, tier, bitDepth), nil
+}
+
+// aacCodecString reads the object type from an esds box, e.g. mp4a.40.2 for AAC-LC.
+func aacCodecString(esds []byte) (string, error) {
+	// skip the full box version and flags
+	if len(esds) < 4 {
+		return "", fmt.Errorf("esds box too short")
+	}
+	r := bytes.NewReader(esds[4:])
+
+	tag, _, err := readDescriptorHeader(r)
+	if err != nil || tag != 0x03 {
+		return "", fmt.Errorf("esds: missing ES descriptor")
+	}
+	var esID uint16
+	if err := binary.Read(r, binary.BigEndian, &esID); err != nil {
+		return "", fmt.Errorf("esds: %w", err)
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("esds: %w", err)
+	}
+	if flags&0x80 != 0 { // streamDependenceFlag
+		r.Seek(2, io.SeekCurrent)
+	}
+	if flags&0x40 != 0 { // URL_Flag
+		urlLength, _ := r.ReadByte()
+		r.Seek(int64(urlLength), io.SeekCurrent)
+	}
+	if flags&0x20 != 0 { // OCRstreamFlag
+		r.Seek(2, io.SeekCurrent)
+	}
+
+	tag, _, err = readDescriptorHeader(r)
+	if err != nil || tag != 0x04 {
+		return "", fmt.Errorf("esds: missing decoder config descriptor")
+	}
+	objectType, err := r.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("esds: %w", err)
+	}
+	if objectType != 0x40 {
+		return fmt.Sprintf("mp4a.%02X", objectType), nil
+	}
+
+	// streamType/bufferSizeDB (4 bytes), maxBitrate and avgBitrate (4 bytes each)
+	r.Seek(12, io.SeekCurrent)
+	tag, _, err = readDescriptorHeader(r)
+	if err != nil || tag != 0x05 {
+		// MPEG-4 audio without a specific config, assume AAC-LC
+		return "mp4a.40.2", nil
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("esds: %w", err)
+	}
+	audioObjectType := int(first >> 3)
+	if audioObjectType == 31 {
+		second, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("esds: %w", err)
+		}
+		audioObjectType = 32 + int(first&0x07)<<3 + int(second>>5)
+	}
+	return fmt.Sprintf("mp4a.40.%d", audioObjectType), nil
+}
+
+// readDescriptorHeader reads an MPEG-4 descriptor tag and its variable length size.
+func readDescriptorHeader(r *bytes.Reader) (byte, int, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		size = size<<7 | int(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return tag, size, nil
+}
+
+// findBox returns the payload of the first ISO-BMFF box of the given type.
+// Init segments are small and the codec configuration boxes are nested deep
+// inside moov/trak/.../stsd, so a scan for the type is simpler than a full
+// box walk and good enough for files we wrote ourselves.
+func findBox(data []byte, boxType string) []byte {
+	needle := []byte(boxType)
+	for offset := 0; ; {
+		i := bytes.Index(data[offset:], needle)
+		if i < 0 {
+			return nil
+		}
+		start := offset + i - 4
+		offset += i + len(needle)
+		if start < 0 {
+			continue
+		}
+		size := int(binary.BigEndian.Uint32(data[start:]))
+		if size < 8 || start+size > len(data) {
+			continue
+		}
+		return data[start+8 : start+size]
+	}
+}
@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// box builds an ISO-BMFF box around payload.
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	out = append(out, boxType...)
+	return append(out, body...)
+}
+
+// initSegment nests a decoder configuration record the way ffmpeg's init
+// segments do, inside a sample entry with its fixed fields in front.
+func initSegment(sampleEntry string, config []byte) []byte {
+	return box("moov", box("trak", box("stsd", make([]byte, 8), box(sampleEntry, make([]byte, 78), config))))
+}
+
+func TestFindBox(t *testing.T) {
+	avcC := []byte{1, 0x64, 0x00, 0x28, 0xFF}
+	data := initSegment("avc1", box("avcC", avcC))
+
+	if got := findBox(data, "avcC"); !bytes.Equal(got, avcC) {
+		t.Errorf("findBox(avcC) = %x, want %x", got, avcC)
+	}
+	if got := findBox(data, "hvcC"); got != nil {
+		t.Errorf("findBox(hvcC) = %x, want nil", got)
+	}
+
+	// the type also shows up as payload bytes, where the size in front of it
+	// runs past the end of the data; the real box after it must still be found
+	decoy := append([]byte{0xFF, 0xFF, 0xFF, 0xFF}, "avcC"...)
+	if got := findBox(append(decoy, data...), "avcC"); !bytes.Equal(got, avcC) {
+		t.Errorf("findBox after a decoy = %x, want %x", got, avcC)
+	}
+	// and at the very start, where there is no size in front of it
+	if got := findBox([]byte("avcC"), "avcC"); got != nil {
+		t.Errorf("findBox without a size = %x, want nil", got)
+	}
+}
+
+func TestVideoCodecString(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"h264 high 4.0", initSegment("avc1", box("avcC", []byte{1, 0x64, 0x00, 0x28})), "avc1.640028", false},
+		{"h264 baseline 3.0", initSegment("avc1", box("avcC", []byte{1, 0x42, 0xC0, 0x1E})), "avc1.42C01E", false},
+		{"h264 short record", initSegment("avc1", box("avcC", []byte{1, 0x64})), "", true},
+		{
+			"hevc main 3.1",
+			initSegment("hvc1", box("hvcC", []byte{1, 0x01, 0x60, 0, 0, 0, 0xB0, 0, 0, 0, 0, 0, 93})),
+			"hvc1.1.6.L93.B0", false,
+		},
+		{
+			"hevc main10 high tier",
+			initSegment("hvc1", box("hvcC", []byte{1, 0x22, 0x20, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 120})),
+			"hvc1.2.4.H120.90", false,
+		},
+		{"hevc short record", initSegment("hvc1", box("hvcC", []byte{1, 0x01, 0x60})), "", true},
+		{"av1 8-bit main 4.0", initSegment("av01", box("av1C", []byte{0x81, 0x08, 0x0C})), "av01.0.08M.08", false},
+		{"av1 10-bit", initSegment("av01", box("av1C", []byte{0x81, 0x08, 0x4C})), "av01.0.08M.10", false},
+		{"av1 12-bit high tier", initSegment("av01", box("av1C", []byte{0x81, 0x4D, 0xE0})), "av01.2.13H.12", false},
+		{"no video", box("moov", box("trak")), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := videoCodecString(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("videoCodecString error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("videoCodecString = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// esds builds an esds payload for an MPEG-4 audio stream. A nil
+// audioSpecificConfig leaves out the decoder specific info.
+func esds(objectType byte, audioSpecificConfig []byte) []byte {
+	decoderConfig := append([]byte{objectType}, make([]byte, 12)...)
+	if audioSpecificConfig != nil {
+		decoderConfig = append(decoderConfig, 0x05, byte(len(audioSpecificConfig)))
+		decoderConfig = append(decoderConfig, audioSpecificConfig...)
+	}
+	// ES_ID and flags, then the decoder config descriptor
+	es := append([]byte{0, 1, 0, 0x04, byte(len(decoderConfig))}, decoderConfig...)
+	return append([]byte{0, 0, 0, 0, 0x03, byte(len(es))}, es...)
+}
+
+func TestAACCodecString(t *testing.T) {
+	tests := []struct {
+		name    string
+		esds    []byte
+		want    string
+		wantErr bool
+	}{
+		{"aac-lc", esds(0x40, []byte{0x12, 0x10}), "mp4a.40.2", false},
+		{"he-aac", esds(0x40, []byte{0x2B, 0x92, 0x08, 0x00}), "mp4a.40.5", false},
+		{"escaped object type", esds(0x40, []byte{0xF8, 0x20}), "mp4a.40.33", false},
+		{"no specific config", esds(0x40, nil), "mp4a.40.2", false},
+		{"mp3", esds(0x6B, nil), "mp4a.6B", false},
+		{"no es descriptor", []byte{0, 0, 0, 0, 0x04, 0}, "", true},
+		{"too short", []byte{0, 0}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := aacCodecString(tt.esds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("aacCodecString error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("aacCodecString = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
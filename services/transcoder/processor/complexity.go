@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// complexitySamples clips of complexitySampleSeconds are test encoded.
+	complexitySamples       = 5
+	complexitySampleSeconds = 2
+	// complexityCRF is the constant quality of the test encodes.
+	complexityCRF = 23
+	// referenceBitsPerPixel is what typical talking-head footage costs at
+	// complexityCRF; the ladder is scaled by how far a video strays from it.
+	referenceBitsPerPixel = 0.06
+	// minComplexityFactor and maxComplexityFactor bound how far the ladder's
+	// bitrates are moved, so a bad sample can't wreck the ladder.
+	minComplexityFactor = 0.4
+	maxComplexityFactor = 1.6
+)
+
+// complexityBox is the size the test encodes run at, the same for every
+// video so their bits per pixel compare.
+var complexityBox = renditionSpec{Width: 1280, Height: 720}
+
+// measureComplexity test encodes short clips spread over the video at a fixed
+// quality and returns how many bits per pixel they needed. Static screencasts
+// come out far below referenceBitsPerPixel, high-motion sports far above.
+func measureComplexity(ctx context.Context, videoPath string, source videoProbe, slots FfmpegSlots) (float64, error) {
+	size := fitToSource(complexityBox, source)
+	size.Tonemap = sourceVideoRange(source.Metadata.Video) != videoRangeSDR
+	frameRate := source.FrameRate
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+
+	var totalBits, totalPixels float64
+	for i := 0; i < complexitySamples; i++ {
+		start := source.Duration * (0.1 + 0.8*float64(i)/float64(complexitySamples-1))
+		length := math.Min(complexitySampleSeconds, source.Duration-start)
+		if length <= 0 {
+			continue
+		}
+
+		var out countingWriter
+		cmd := exec.CommandContext(ctx, "ffmpeg",
+			"-hide_banner", "-loglevel", "error",
+			"-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", length), "-i", videoPath,
+			"-map", "0:v:0", "-an", "-sn",
+			"-vf", videoFilter(size), "-pix_fmt", "yuv420p",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", strconv.Itoa(complexityCRF),
+			"-f", "mpegts", "pipe:1",
+		)
+		cmd.Stdout = &out
+		if err := slots.run(ctx, cmd); err != nil {
+			return 0, fmt.Errorf("test encode at %.1fs: %w", start, err)
+		}
+
+		totalBits += float64(out.n) * 8
+		totalPixels += float64(size.Width*size.Height) * frameRate * length
+	}
+	if totalPixels == 0 {
+		return 0, fmt.Errorf("video too short to sample")
+	}
+	return totalBits / totalPixels, nil
+}
+
+// adaptLadder fits a ladder to a video of the given complexity. Bitrate caps
+// scale with complexity so hard content isn't starved and easy content isn't
+// over-spent; the crf moves against it, so hard content is encoded at a
+// lower crf to hold its quality and easy content at a higher one where the
+// extra bits wouldn't be seen. A rung is dropped when the rung above it now
+// costs no more than the dropped rung did in the fixed ladder, as a
+// screencast's 1080p can be cheaper than an ordinary 720p. The smallest rung
+// is always kept.
+func adaptLadder(ladder []renditionSpec, bitsPerPixel float64) ([]renditionSpec, float64) {
+	// walk the rungs from the most expensive down
+	ladder = slices.Clone(ladder)
+	sort.SliceStable(ladder, func(i, j int) bool {
+		a, _ := parseBitrate(ladder[i].MaxBitrate)
+		b, _ := parseBitrate(ladder[j].MaxBitrate)
+		return a > b
+	})
+
+	factor := math.Max(minComplexityFactor, math.Min(maxComplexityFactor, bitsPerPixel/referenceBitsPerPixel))
+	crfDelta := int(math.Round(2 * math.Log2(factor)))
+
+	adapted := make([]renditionSpec, 0, len(ladder))
+	var lastKeptBitrate int
+	for i, r := range ladder {
+		original, _ := parseBitrate(r.MaxBitrate)
+
+		r.CRF = max(0, min(maxCRF[r.Codec], r.CRF-crfDelta))
+		r.MaxBitrate = scaleBitrate(r.MaxBitrate, factor)
+		r.BufSize = scaleBitrate(r.BufSize, factor)
+		r.Bandwidth = int(float64(r.Bandwidth) * factor)
+		scaled, _ := parseBitrate(r.MaxBitrate)
+
+		isLast := i == len(ladder)-1
+		if len(adapted) > 0 && !isLast && lastKeptBitrate <= original {
+			continue
+		}
+		adapted = append(adapted, r)
+		lastKeptBitrate = scaled
+	}
+	return adapted, factor
+}
+
+// contentAwareLadder measures the video and adapts the planned ladder to it.
+// If the measurement fails the planned ladder is used unchanged.
+func contentAwareLadder(ctx context.Context, videoPath string, source videoProbe, planned []renditionSpec, slots FfmpegSlots, logger *zap.Logger) ([]renditionSpec, float64) {
+	bitsPerPixel, err := measureComplexity(ctx, videoPath, source, slots)
+	if err != nil {
+		logger.Warn("complexity analysis failed, using the fixed ladder", zap.Error(err))
+		return planned, 0
+	}
+
+	adapted, factor := adaptLadder(planned, bitsPerPixel)
+	logger.Info("content-aware ladder chosen",
+		zap.Float64("bitsPerPixel", bitsPerPixel),
+		zap.Float64("factor", factor),
+		zap.Int("rungs", len(adapted)))
+	return adapted, bitsPerPixel
+}
+
+// countingWriter discards what is written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
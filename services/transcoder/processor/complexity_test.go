@@ -0,0 +1,62 @@
+package processor
+
+import "testing"
+
+func TestAdaptLadder(t *testing.T) {
+	ladder := builtinProfiles().profiles[defaultProfileName].Renditions
+
+	// average content leaves the ladder as it is
+	adapted, factor := adaptLadder(ladder, referenceBitsPerPixel)
+	if factor != 1 || len(adapted) != len(ladder) {
+		t.Fatalf("reference complexity gave factor %v and %d rungs, want 1 and %d", factor, len(adapted), len(ladder))
+	}
+	for i := range ladder {
+		if adapted[i].CRF != ladder[i].CRF || adapted[i].MaxBitrate != ladder[i].MaxBitrate {
+			t.Errorf("%s changed to crf %d at %s", ladder[i].Name, adapted[i].CRF, adapted[i].MaxBitrate)
+		}
+	}
+
+	// hard content gets more bits and a lower crf, and keeps every rung
+	adapted, factor = adaptLadder(ladder, 10*referenceBitsPerPixel)
+	if factor != maxComplexityFactor || len(adapted) != len(ladder) {
+		t.Fatalf("hard content gave factor %v and %d rungs, want %v and %d", factor, len(adapted), maxComplexityFactor, len(ladder))
+	}
+	if adapted[0].MaxBitrate != "8000k" || adapted[0].CRF != ladder[0].CRF-1 {
+		t.Errorf("hard content 1080p = crf %d at %s, want crf %d at 8000k", adapted[0].CRF, adapted[0].MaxBitrate, ladder[0].CRF-1)
+	}
+
+	// easy content drops the rungs the one above now costs no more than
+	adapted, factor = adaptLadder(ladder, referenceBitsPerPixel/10)
+	if factor != minComplexityFactor {
+		t.Fatalf("easy content gave factor %v, want %v", factor, minComplexityFactor)
+	}
+	if got := names(adapted); len(got) != 2 || got[0] != "1080p" || got[1] != "480p" {
+		t.Errorf("easy content kept %v, want 1080p and 480p", got)
+	}
+	if adapted[0].CRF != ladder[0].CRF+3 {
+		t.Errorf("easy content 1080p crf = %d, want %d", adapted[0].CRF, ladder[0].CRF+3)
+	}
+}
+
+func TestAdaptLadderKeepsCRFOnScale(t *testing.T) {
+	ladder := []renditionSpec{
+		{Name: "1080p", CRF: 50, MaxBitrate: "5000k", BufSize: "10000k"},
+		{Name: "1080p_av1", Codec: codecAV1, CRF: 62, MaxBitrate: "1500k", BufSize: "3000k"},
+		{Name: "360p", CRF: 1, MaxBitrate: "600k", BufSize: "1200k"},
+	}
+
+	easy, _ := adaptLadder(ladder, referenceBitsPerPixel/10)
+	for _, r := range easy {
+		if limit := maxCRF[r.Codec]; r.CRF > limit {
+			t.Errorf("easy content %s crf = %d, past its codec's %d", r.Name, r.CRF, limit)
+		}
+	}
+	if easy[0].CRF != 51 || easy[1].CRF != 63 {
+		t.Errorf("easy content crfs = %d and %d, want 51 and 63", easy[0].CRF, easy[1].CRF)
+	}
+
+	hard, _ := adaptLadder(ladder, 10*referenceBitsPerPixel)
+	if last := hard[len(hard)-1]; last.CRF != 0 {
+		t.Errorf("hard content %s crf = %d, want it clamped to 0", last.Name, last.CRF)
+	}
+}
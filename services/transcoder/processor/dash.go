@@ -0,0 +1,248 @@
+package processor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The DASH manifest reuses the CMAF segments written for HLS, addressing them
+// with an explicit SegmentList so the chunk names and durations match the HLS
+// media playlists exactly.
+
+type mpd struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Xmlns                     string      `xml:"xmlns,attr"`
+	Profiles                  string      `xml:"profiles,attr"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string      `xml:"minBufferTime,attr"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID                  int                 `xml:"id,attr"`
+	ContentType         string              `xml:"contentType,attr"`
+	MimeType            string              `xml:"mimeType,attr"`
+	SegmentAlignment    bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP        int                 `xml:"startWithSAP,attr"`
+	Lang                string              `xml:"lang,attr,omitempty"`
+	EssentialProperties []mpdDescriptor     `xml:"EssentialProperty"`
+	Roles               []mpdDescriptor     `xml:"Role"`
+	Representations     []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                  string          `xml:"id,attr"`
+	Bandwidth           int             `xml:"bandwidth,attr"`
+	Width               int             `xml:"width,attr,omitempty"`
+	Height              int             `xml:"height,attr,omitempty"`
+	FrameRate           string          `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate   int             `xml:"audioSamplingRate,attr,omitempty"`
+	Codecs              string          `xml:"codecs,attr"`
+	AudioChannelConfigs []mpdDescriptor `xml:"AudioChannelConfiguration"`
+	BaseURL             string          `xml:"BaseURL"`
+	SegmentList         mpdSegmentList  `xml:"SegmentList"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdSegmentList struct {
+	Timescale      int               `xml:"timescale,attr"`
+	Initialization mpdInitialization `xml:"Initialization"`
+	Timeline       []mpdTimelineS    `xml:"SegmentTimeline>S"`
+	SegmentURLs    []mpdSegmentURL   `xml:"SegmentURL"`
+}
+
+type mpdInitialization struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type mpdTimelineS struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+type mpdSegmentURL struct {
+	Media string `xml:"media,attr"`
+}
+
+// dashTimescale expresses segment timing in milliseconds.
+const dashTimescale = 1000
+
+// writeDashManifest writes a static MPEG-DASH manifest for the produced
+// renditions next to the HLS master playlist.
+//
+// Players only switch between representations of one adaptation set, so each
+// video codec gets its own and players pick the set they can decode. HDR
+// renditions get sets of their own too, marked with their colour properties
+// so players that can't display them skip the set.
+func writeDashManifest(dst string, items []renditionOutput, audio []renditionOutput, duration float64) error {
+	var adaptationSets []mpdAdaptationSet
+	videoSets := make(map[string]int) // codec family and range -> index in adaptationSets
+
+	for _, it := range items {
+		family, _, _ := strings.Cut(it.Codecs, ".")
+		key := family + "/" + it.VideoRange
+		index, ok := videoSets[key]
+		if !ok {
+			index = len(adaptationSets)
+			videoSets[key] = index
+			adaptationSets = append(adaptationSets, mpdAdaptationSet{
+				ID:                  index,
+				ContentType:         "video",
+				MimeType:            "video/mp4",
+				SegmentAlignment:    true,
+				StartWithSAP:        1,
+				EssentialProperties: dashColorProperties(it.VideoRange),
+			})
+		}
+		video := &adaptationSets[index]
+		video.Representations = append(video.Representations, mpdRepresentation{
+			ID:          it.Name,
+			Bandwidth:   it.PeakBandwidth,
+			Width:       it.Width,
+			Height:      it.Height,
+			FrameRate:   it.FrameRate.dash(),
+			Codecs:      it.Codecs,
+			BaseURL:     it.Name + "/",
+			SegmentList: dashSegmentList(it.Playlist),
+		})
+	}
+
+	// one adaptation set per audio track so players can offer them as languages
+	for _, a := range audio {
+		adaptationSets = append(adaptationSets, mpdAdaptationSet{
+			ID:               len(adaptationSets),
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Lang:             a.Audio.Language,
+			Roles: []mpdDescriptor{{
+				SchemeIDURI: "urn:mpeg:dash:role:2011",
+				Value:       dashAudioRole(*a.Audio),
+			}},
+			Representations: []mpdRepresentation{{
+				ID:                a.Name,
+				Bandwidth:         a.PeakBandwidth,
+				AudioSamplingRate: audioSampleRate,
+				Codecs:            a.Codecs,
+				AudioChannelConfigs: []mpdDescriptor{{
+					SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       strconv.Itoa(a.Audio.Channels),
+				}},
+				BaseURL:     a.Name + "/",
+				SegmentList: dashSegmentList(a.Playlist),
+			}},
+		})
+	}
+
+	manifest := mpd{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-main:2011",
+		Type:                      "static",
+		MediaPresentationDuration: dashDuration(duration),
+		MinBufferTime:             dashDuration(hlsSegmentSeconds),
+		Periods: []mpdPeriod{{
+			ID:             "0",
+			Start:          "PT0S",
+			AdaptationSets: adaptationSets,
+		}},
+	}
+
+	body, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	return os.WriteFile(dst, append([]byte(xml.Header), append(body, '\n')...), 0644)
+}
+
+// dashColorProperties describes an HDR range with the ISO/IEC 23001-8 (CICP)
+// code points DASH-IF defines for it; SDR needs none.
+func dashColorProperties(videoRange string) []mpdDescriptor {
+	transfer := map[string]string{videoRangePQ: "16", videoRangeHLG: "18"}[videoRange]
+	if transfer == "" {
+		return nil
+	}
+	return []mpdDescriptor{
+		{SchemeIDURI: "urn:mpeg:mpegB:cicp:ColourPrimaries", Value: "9"},
+		{SchemeIDURI: "urn:mpeg:mpegB:cicp:TransferCharacteristics", Value: transfer},
+		{SchemeIDURI: "urn:mpeg:mpegB:cicp:MatrixCoefficients", Value: "9"},
+	}
+}
+
+// dashAudioRole maps an audio track onto the DASH role scheme.
+func dashAudioRole(a audioSpec) string {
+	switch {
+	case a.Commentary:
+		return "commentary"
+	case a.VisualImpaired:
+		return "description"
+	case a.Default:
+		return "main"
+	default:
+		return "alternate"
+	}
+}
+
+// dashSegmentList maps an HLS media playlist onto a DASH SegmentList with a
+// run-length encoded SegmentTimeline. Start times are rounded from the running
+// total so rounding errors don't accumulate over long videos.
+func dashSegmentList(playlist mediaPlaylist) mpdSegmentList {
+	list := mpdSegmentList{
+		Timescale:      dashTimescale,
+		Initialization: mpdInitialization{SourceURL: playlist.InitURI},
+	}
+
+	var elapsed float64
+	var start int64
+	for i, seg := range playlist.Segments {
+		elapsed += seg.Duration
+		end := int64(math.Round(elapsed * dashTimescale))
+		d := end - start
+
+		last := len(list.Timeline) - 1
+		if last >= 0 && list.Timeline[last].D == d {
+			list.Timeline[last].R++
+		} else {
+			entry := mpdTimelineS{D: d}
+			if i == 0 {
+				zero := int64(0)
+				entry.T = &zero
+			}
+			list.Timeline = append(list.Timeline, entry)
+		}
+
+		list.SegmentURLs = append(list.SegmentURLs, mpdSegmentURL{Media: seg.URI})
+		start = end
+	}
+	return list
+}
+
+// dash formats a frame rate as the DASH frameRate attribute, exactly as the
+// rung was encoded (e.g. 30000/1001 or 25/2); empty if it is unknown.
+func (f frameRate) dash() string {
+	if f.Num <= 0 || f.Den <= 0 {
+		return ""
+	}
+	return f.String()
+}
+
+// dashDuration formats seconds as an xs:duration, e.g. PT12.345S.
+func dashDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
@@ -0,0 +1,222 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// contentKeySize is the key length of AES-128.
+const contentKeySize = 16
+
+// keyURLPlaceholder is replaced with the video ID in EncryptionOptions.KeyURL.
+const keyURLPlaceholder = "{videoId}"
+
+// videoIDPattern keeps video IDs safe to use in key object names.
+var videoIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// EncryptionOptions turns on HLS AES-128 encryption of every segment.
+//
+// CBCS (SAMPLE-AES) would need a CMAF packager; ffmpeg's HLS muxer only does
+// whole-segment AES-128, which is why DASH isn't published for encrypted
+// videos: DASH players expect CENC.
+type EncryptionOptions struct {
+	// Keys provides the content key of each video; nil disables encryption.
+	Keys KeyProvider
+	// KeyURL is where players fetch a video's key from, with {videoId} in it,
+	// e.g. https://api.example.com/videos/{videoId}/key.
+	KeyURL string
+}
+
+// enabled reports whether videos are encrypted.
+func (o EncryptionOptions) enabled() bool {
+	return o.Keys != nil
+}
+
+// keyURL returns the key URI written to the playlists of a video.
+func (o EncryptionOptions) keyURL(videoID string) string {
+	return strings.ReplaceAll(o.KeyURL, keyURLPlaceholder, videoID)
+}
+
+// ContentKey is the AES-128 key a video's segments are encrypted with.
+type ContentKey struct {
+	// ID identifies the key without revealing it.
+	ID  string
+	Key []byte
+}
+
+// KeyProvider hands out the content key of a video. It must return the same
+// key every time it is asked for the same video, so a redelivered request
+// can reuse the segments an earlier attempt encrypted.
+type KeyProvider interface {
+	ContentKey(ctx context.Context, videoID string) (ContentKey, error)
+}
+
+// FileKeyProvider keeps one key file per video in a directory, creating the
+// key the first time a video asks for it. With more than one replica the
+// directory has to be shared storage, or a redelivery landing on another pod
+// gets a different key; S3KeyProvider has no such requirement.
+type FileKeyProvider struct {
+	dir string
+}
+
+// NewFileKeyProvider returns a provider keeping its keys in dir, which is
+// created if it doesn't exist.
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create key directory: %w", err)
+	}
+	return &FileKeyProvider{dir: dir}, nil
+}
+
+// ContentKey reads the key of a video from <dir>/<videoID>.key, creating it
+// with a random key first if needed.
+func (p *FileKeyProvider) ContentKey(ctx context.Context, videoID string) (ContentKey, error) {
+	if !videoIDPattern.MatchString(videoID) {
+		return ContentKey{}, fmt.Errorf("invalid video ID %q", videoID)
+	}
+	keyPath := filepath.Join(p.dir, videoID+".key")
+
+	key := make([]byte, contentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return ContentKey{}, fmt.Errorf("generate content key: %w", err)
+	}
+	// O_EXCL so two deliveries of one video can't end up with different keys
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	switch {
+	case err == nil:
+		_, err = f.Write(key)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(keyPath)
+			return ContentKey{}, fmt.Errorf("write content key: %w", err)
+		}
+	case errors.Is(err, fs.ErrExist):
+		key, err = os.ReadFile(keyPath)
+		if err != nil {
+			return ContentKey{}, fmt.Errorf("read content key: %w", err)
+		}
+		if len(key) != contentKeySize {
+			return ContentKey{}, fmt.Errorf("content key %s is %d bytes, want %d", keyPath, len(key), contentKeySize)
+		}
+	default:
+		return ContentKey{}, fmt.Errorf("create content key: %w", err)
+	}
+
+	return ContentKey{ID: keyID(key), Key: key}, nil
+}
+
+// S3KeyProvider keeps one key object per video under a private prefix of the
+// bucket, encrypted at rest, creating the key the first time a video asks for
+// it. Every transcoder replica and whatever serves the keys to players see
+// the same keys, so a request redelivered to another pod reuses the key its
+// segments were encrypted with.
+type S3KeyProvider struct {
+	s3Client *s3.S3
+	bucket   string
+	prefix   string
+	// kmsKeyID encrypts the key objects with SSE-KMS; "" uses SSE-S3
+	kmsKeyID string
+}
+
+// NewS3KeyProvider returns a provider keeping its keys in bucket under
+// prefix. The prefix must not be publicly readable.
+func NewS3KeyProvider(s3Client *s3.S3, bucket, prefix, kmsKeyID string) *S3KeyProvider {
+	return &S3KeyProvider{s3Client: s3Client, bucket: bucket, prefix: prefix, kmsKeyID: kmsKeyID}
+}
+
+// ContentKey reads the key of a video from <prefix>/<videoID>.key, creating
+// it with a random key first if needed.
+func (p *S3KeyProvider) ContentKey(ctx context.Context, videoID string) (ContentKey, error) {
+	if !videoIDPattern.MatchString(videoID) {
+		return ContentKey{}, fmt.Errorf("invalid video ID %q", videoID)
+	}
+	objectKey := path.Join(p.prefix, videoID+".key")
+
+	key := make([]byte, contentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return ContentKey{}, fmt.Errorf("generate content key: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(p.bucket),
+		Key:                  aws.String(objectKey),
+		Body:                 bytes.NewReader(key),
+		ContentType:          aws.String("application/octet-stream"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	}
+	if p.kmsKeyID != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(p.kmsKeyID)
+	}
+	req, _ := p.s3Client.PutObjectRequest(input)
+	req.SetContext(ctx)
+	// only the first delivery of a video writes its key, so two can't end up
+	// with different keys; the SDK has no field for the condition
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	err := req.Send()
+	switch {
+	case err == nil:
+	case isPreconditionFailed(err):
+		key, err = getObject(ctx, p.s3Client, p.bucket, objectKey)
+		if err != nil {
+			return ContentKey{}, fmt.Errorf("read content key: %w", err)
+		}
+		if len(key) != contentKeySize {
+			return ContentKey{}, fmt.Errorf("content key %s is %d bytes, want %d", objectKey, len(key), contentKeySize)
+		}
+	default:
+		// a conflicting concurrent write lands here too; the retry reads the winner's key
+		return ContentKey{}, fmt.Errorf("create content key: %w", err)
+	}
+
+	return ContentKey{ID: keyID(key), Key: key}, nil
+}
+
+// isPreconditionFailed reports whether err is S3 refusing a conditional
+// write because the object already exists.
+func isPreconditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "PreconditionFailed"
+}
+
+// keyID derives a key's ID from a hash of the key.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// writeKeyInfo writes the key and the key info file ffmpeg's HLS muxer reads
+// (key URI, then key file) into the staging directory. It returns the key
+// info file's path relative to the encodes' working directories, which stays
+// the same across attempts so it doesn't change the checkpoint fingerprints;
+// the key ID in its name does change them if the key changes.
+func writeKeyInfo(stagingDir string, key ContentKey, keyURL string) (string, error) {
+	keyPath := filepath.Join(stagingDir, key.ID+".key")
+	if err := os.WriteFile(keyPath, key.Key, 0600); err != nil {
+		return "", fmt.Errorf("write key file: %w", err)
+	}
+
+	name := key.ID + ".keyinfo"
+	info := keyURL + "\n" + keyPath + "\n"
+	if err := os.WriteFile(filepath.Join(stagingDir, name), []byte(info), 0600); err != nil {
+		return "", fmt.Errorf("write key info file: %w", err)
+	}
+	// every encode runs in its own directory right under the staging directory
+	return filepath.Join("..", name), nil
+}
@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+)
+
+// defaultMaxFrameRate caps the rungs that don't set maxFrameRate.
+const defaultMaxFrameRate = 60
+
+// fallbackFrameRate is used when the source doesn't report a frame rate.
+var fallbackFrameRate = frameRate{Num: 30, Den: 1}
+
+// standardFrameRates are the rates a source's average frame rate is snapped
+// to, so a phone's 29.98 average becomes NTSC 30000/1001 again.
+var standardFrameRates = []frameRate{
+	{24000, 1001}, {24, 1}, {25, 1}, {30000, 1001}, {30, 1},
+	{48, 1}, {50, 1}, {60000, 1001}, {60, 1}, {120000, 1001}, {120, 1},
+}
+
+// frameRate is an exact frame rate such as 30000/1001.
+type frameRate struct {
+	Num int
+	Den int
+}
+
+func (f frameRate) String() string {
+	if f.Den == 1 {
+		return fmt.Sprint(f.Num)
+	}
+	return fmt.Sprintf("%d/%d", f.Num, f.Den)
+}
+
+func (f frameRate) float() float64 {
+	if f.Den == 0 {
+		return 0
+	}
+	return float64(f.Num) / float64(f.Den)
+}
+
+// sourceFrameRate picks the constant frame rate that stands in for the
+// source's, variable or not: its average rate snapped to the nearest
+// standard rate within 5%, as phones recording at a variable rate average a
+// little under their nominal one, or else rounded to a thousandth of a frame.
+func sourceFrameRate(average float64) frameRate {
+	if average <= 0 {
+		return fallbackFrameRate
+	}
+	nearest := standardFrameRates[0]
+	for _, standard := range standardFrameRates[1:] {
+		if math.Abs(average-standard.float()) < math.Abs(average-nearest.float()) {
+			nearest = standard
+		}
+	}
+	if math.Abs(average-nearest.float()) <= nearest.float()*0.05 {
+		return nearest
+	}
+	num, den := int(math.Round(average*1000)), 1000
+	divisor := gcd(num, den)
+	return frameRate{Num: num / divisor, Den: den / divisor}
+}
+
+// capped halves the frame rate until it is at most limit, so every frame
+// that is kept is a source frame and motion keeps its cadence.
+func (f frameRate) capped(limit float64) frameRate {
+	for f.float() > limit+0.01 {
+		if f.Num%2 == 0 {
+			f.Num /= 2
+		} else {
+			f.Den *= 2
+		}
+	}
+	return f
+}
+
+// planFrameRates sets the constant frame rate of every rung, the source's
+// capped at the rung's maxFrameRate, and the keyframe grid they share.
+func planFrameRates(renditions []renditionSpec, source frameRate) {
+	if len(renditions) == 0 {
+		return
+	}
+	grid := source
+	for i := range renditions {
+		limit := renditions[i].MaxFrameRate
+		if limit <= 0 {
+			limit = defaultMaxFrameRate
+		}
+		renditions[i].FrameRate = source.capped(limit)
+		if renditions[i].FrameRate.float() < grid.float() {
+			grid = renditions[i].FrameRate
+		}
+	}
+	for i := range renditions {
+		renditions[i].KeyframeGrid = grid
+	}
+}
+
+// keyframeExpr forces a keyframe on the first frame of every segment.
+// Frames are counted on the ladder's lowest frame rate, whose frames every
+// other rung has too as all rates are the source's halved, so segments start
+// on the same instant in every rendition even at NTSC rates, where a segment
+// isn't a whole number of frames.
+func keyframeExpr(r renditionSpec) string {
+	if r.FrameRate.Num == 0 || r.KeyframeGrid.Num == 0 {
+		return fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds)
+	}
+	// frames of this rung per frame of the grid, a power of two
+	step := int(math.Round(r.FrameRate.float() / r.KeyframeGrid.float()))
+	return fmt.Sprintf("expr:gte(n,ceil(n_forced*%d*%d/%d)*%d)",
+		hlsSegmentSeconds, r.KeyframeGrid.Num, r.KeyframeGrid.Den, step)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
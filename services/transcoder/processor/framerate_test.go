@@ -0,0 +1,100 @@
+package processor
+
+import "testing"
+
+func TestSourceFrameRate(t *testing.T) {
+	tests := []struct {
+		average float64
+		want    frameRate
+	}{
+		{0, fallbackFrameRate},
+		{-1, fallbackFrameRate},
+		{24, frameRate{24, 1}},
+		{23.976, frameRate{24000, 1001}},
+		{29.97, frameRate{30000, 1001}},
+		// phones recording at a variable rate average under their nominal one
+		{29.5, frameRate{30000, 1001}},
+		{59.94, frameRate{60000, 1001}},
+		{50.2, frameRate{50, 1}},
+		// too far from a standard rate, kept to a thousandth of a frame
+		{15, frameRate{15, 1}},
+		{12.5, frameRate{25, 2}},
+		{100, frameRate{100, 1}},
+	}
+	for _, tt := range tests {
+		if got := sourceFrameRate(tt.average); got != tt.want {
+			t.Errorf("sourceFrameRate(%v) = %v, want %v", tt.average, got, tt.want)
+		}
+	}
+}
+
+func TestFrameRateCapped(t *testing.T) {
+	tests := []struct {
+		rate  frameRate
+		limit float64
+		want  frameRate
+	}{
+		{frameRate{60, 1}, 60, frameRate{60, 1}},
+		{frameRate{60, 1}, 30, frameRate{30, 1}},
+		{frameRate{120, 1}, 30, frameRate{30, 1}},
+		{frameRate{60000, 1001}, 30, frameRate{30000, 1001}},
+		// 29.97 is within the tolerance of a 29.97 cap
+		{frameRate{30000, 1001}, 29.97, frameRate{30000, 1001}},
+		{frameRate{25, 1}, 24, frameRate{25, 2}},
+		{frameRate{50, 1}, 20, frameRate{25, 2}},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.capped(tt.limit); got != tt.want {
+			t.Errorf("%v capped at %v = %v, want %v", tt.rate, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestPlanFrameRates(t *testing.T) {
+	renditions := []renditionSpec{{Name: "1080p"}, {Name: "360p", MaxFrameRate: 30}}
+	planFrameRates(renditions, frameRate{60000, 1001})
+
+	if renditions[0].FrameRate != (frameRate{60000, 1001}) {
+		t.Errorf("1080p frame rate = %v, want the source's", renditions[0].FrameRate)
+	}
+	if renditions[1].FrameRate != (frameRate{30000, 1001}) {
+		t.Errorf("360p frame rate = %v, want half the source's", renditions[1].FrameRate)
+	}
+	for _, r := range renditions {
+		if r.KeyframeGrid != (frameRate{30000, 1001}) {
+			t.Errorf("%s keyframe grid = %v, want the lowest rate 30000/1001", r.Name, r.KeyframeGrid)
+		}
+	}
+}
+
+func TestKeyframeExpr(t *testing.T) {
+	tests := []struct {
+		name string
+		r    renditionSpec
+		want string
+	}{
+		{"no frame rate", renditionSpec{}, "expr:gte(t,n_forced*4)"},
+		{
+			"same as grid",
+			renditionSpec{FrameRate: frameRate{30, 1}, KeyframeGrid: frameRate{30, 1}},
+			"expr:gte(n,ceil(n_forced*4*30/1)*1)",
+		},
+		{
+			"twice the grid",
+			renditionSpec{FrameRate: frameRate{60, 1}, KeyframeGrid: frameRate{30, 1}},
+			"expr:gte(n,ceil(n_forced*4*30/1)*2)",
+		},
+		{
+			"ntsc",
+			renditionSpec{FrameRate: frameRate{60000, 1001}, KeyframeGrid: frameRate{30000, 1001}},
+			"expr:gte(n,ceil(n_forced*4*30000/1001)*2)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyframeExpr(tt.r); got != tt.want {
+				t.Errorf("keyframeExpr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package processor
+
+import "github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+
+// Dynamic ranges as the HLS VIDEO-RANGE attribute names them.
+const (
+	videoRangeSDR = "SDR"
+	videoRangePQ  = "PQ"
+	videoRangeHLG = "HLG"
+)
+
+// hdrSuffix names the HDR copy of a rung, e.g. 1080p_hdr.
+const hdrSuffix = "_hdr"
+
+// tonemapFilter brings HDR frames down to SDR BT.709: it linearizes them,
+// converts the BT.2020 primaries, compresses the highlights with the Hable
+// curve and applies the BT.709 transfer again. npl is the luminance, in nits,
+// SDR white ends up at.
+const tonemapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+	"tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// sourceVideoRange classifies the source by its transfer function. Dolby
+// Vision with an HDR10 or HLG base layer counts as that; without one there
+// is nothing to tone map from and it is treated as SDR.
+func sourceVideoRange(video types.VideoMetadata) string {
+	switch video.ColorTransfer {
+	case "smpte2084":
+		return videoRangePQ
+	case "arib-std-b67":
+		return videoRangeHLG
+	}
+	return videoRangeSDR
+}
+
+// sdrFilter returns tonemapFilter, comma first to append to a filter chain,
+// for an HDR source and nothing for an SDR one. Posters, the storyboard and
+// the preview are always SDR.
+func sdrFilter(source videoProbe) string {
+	if sourceVideoRange(source.Metadata.Video) == videoRangeSDR {
+		return ""
+	}
+	return "," + tonemapFilter
+}
+
+// videoRange returns the dynamic range a rung is encoded in.
+func (r renditionSpec) videoRange() string {
+	if r.VideoRange == "" {
+		return videoRangeSDR
+	}
+	return r.VideoRange
+}
+
+// hdrRenditions derives 10-bit HEVC rungs that keep the dynamic range of an
+// HDR source from the planned H.264 rungs. They are encoded like the
+// profile's HEVC copy, or with the HEVC defaults if it has none. SDR sources
+// and profiles without hdr get none.
+func (p encodingProfile) hdrRenditions(planned []renditionSpec, videoRange string) []renditionSpec {
+	if !p.HDR || videoRange == videoRangeSDR {
+		return nil
+	}
+
+	variant := codecDefaults[codecHEVC]
+	for _, v := range p.AdditionalCodecs {
+		if v.Codec == codecHEVC {
+			variant = v
+		}
+	}
+
+	derived := make([]renditionSpec, 0, len(planned))
+	for _, r := range planned {
+		r = variant.apply(r)
+		r.Name = r.Name + hdrSuffix
+		r.VideoRange = videoRange
+		r.Tonemap = false
+		derived = append(derived, r)
+	}
+	return derived
+}
+
+// colorArgs sets the pixel format of a rung and tags its colour properties,
+// 8-bit BT.709 for SDR and 10-bit BT.2020 for HDR.
+func colorArgs(r renditionSpec) []string {
+	switch r.VideoRange {
+	case videoRangePQ, videoRangeHLG:
+		return []string{
+			"-pix_fmt", "yuv420p10le",
+			"-color_primaries", "bt2020",
+			"-color_trc", hdrTransfer(r.VideoRange),
+			"-colorspace", "bt2020nc",
+		}
+	}
+	args := []string{"-pix_fmt", "yuv420p"}
+	if r.Tonemap {
+		args = append(args, "-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709")
+	}
+	return args
+}
+
+// x265HDRParams signals the colour properties of an HDR rung in the HEVC
+// VUI, where players look for them.
+func x265HDRParams(videoRange string) string {
+	params := "colorprim=bt2020:transfer=" + hdrTransfer(videoRange) + ":colormatrix=bt2020nc"
+	if videoRange == videoRangePQ {
+		params += ":hdr10-opt=1"
+	}
+	return params
+}
+
+// hdrTransfer names the transfer function of an HDR range as ffmpeg and x265 do.
+func hdrTransfer(videoRange string) string {
+	if videoRange == videoRangeHLG {
+		return "arib-std-b67"
+	}
+	return "smpte2084"
+}
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mediaSegment is one entry of a media playlist.
+type mediaSegment struct {
+	URI      string
+	Duration float64
+}
+
+// mediaPlaylist is the parsed form of a rendition's index.m3u8.
+type mediaPlaylist struct {
+	TargetDuration int
+	InitURI        string
+	Segments       []mediaSegment
+	// EndList is set once the playlist is complete (#EXT-X-ENDLIST)
+	EndList bool
+}
+
+// parseMediaPlaylist reads the media playlist ffmpeg wrote for a rendition.
+func parseMediaPlaylist(playlistPath string) (mediaPlaylist, error) {
+	f, err := os.Open(playlistPath)
+	if err != nil {
+		return mediaPlaylist{}, err
+	}
+	defer f.Close()
+
+	return readMediaPlaylist(f, playlistPath)
+}
+
+// readMediaPlaylist parses a media playlist; name is only used in errors.
+func readMediaPlaylist(r io.Reader, name string) (mediaPlaylist, error) {
+	var playlist mediaPlaylist
+	pendingDuration := -1.0
+
+	var err error
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			playlist.TargetDuration, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+			if err != nil {
+				return mediaPlaylist{}, fmt.Errorf("parse target duration %q: %w", line, err)
+			}
+		case line == "#EXT-X-ENDLIST":
+			playlist.EndList = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			playlist.InitURI = attributeValue(strings.TrimPrefix(line, "#EXT-X-MAP:"), "URI")
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			pendingDuration, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return mediaPlaylist{}, fmt.Errorf("parse segment duration %q: %w", line, err)
+			}
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if pendingDuration < 0 {
+				return mediaPlaylist{}, fmt.Errorf("segment %q has no #EXTINF", line)
+			}
+			playlist.Segments = append(playlist.Segments, mediaSegment{URI: line, Duration: pendingDuration})
+			pendingDuration = -1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return mediaPlaylist{}, err
+	}
+
+	if len(playlist.Segments) == 0 {
+		return mediaPlaylist{}, fmt.Errorf("playlist %s has no segments", name)
+	}
+	return playlist, nil
+}
+
+// attributeValue returns the value of key in an HLS attribute list such as
+// `URI="init.mp4",BYTERANGE="..."`, with quotes removed.
+func attributeValue(attributes, key string) string {
+	for _, pair := range splitAttributes(attributes) {
+		name, value, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(name) == key {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// splitAttributes splits an HLS attribute list on the commas that aren't
+// inside quoted values.
+func splitAttributes(attributes string) []string {
+	var pairs []string
+	inQuotes := false
+	start := 0
+	for i, c := range attributes {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ',' && !inQuotes:
+			pairs = append(pairs, attributes[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(attributes) {
+		pairs = append(pairs, attributes[start:])
+	}
+	return pairs
+}
+
+// measureBandwidth computes the peak and average bitrate of a rendition from
+// its segment sizes, as HLS defines BANDWIDTH and AVERAGE-BANDWIDTH. It
+// reports false when a segment in the playlist has no recorded size.
+func measureBandwidth(playlist mediaPlaylist, sizes map[string]int64) (int, int, bool) {
+	var peak, totalBits, totalSeconds float64
+	for _, seg := range playlist.Segments {
+		size, ok := sizes[seg.URI]
+		if !ok || seg.Duration <= 0 {
+			return 0, 0, false
+		}
+		bits := float64(size) * 8
+		peak = max(peak, bits/seg.Duration)
+		totalBits += bits
+		totalSeconds += seg.Duration
+	}
+	if totalSeconds == 0 {
+		return 0, 0, false
+	}
+	return int(math.Ceil(peak)), int(math.Ceil(totalBits / totalSeconds)), true
+}
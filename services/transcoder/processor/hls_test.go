@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadMediaPlaylist(t *testing.T) {
+	raw := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"800@0\"\n" +
+		"#EXTINF:4.004,\n" +
+		"seg_00000.m4s\n" +
+		"\n" +
+		"#EXTINF:1.5,\n" +
+		"seg_00001.m4s\n" +
+		"#EXT-X-ENDLIST\n"
+
+	playlist, err := readMediaPlaylist(strings.NewReader(raw), "720p")
+	if err != nil {
+		t.Fatalf("readMediaPlaylist: %v", err)
+	}
+	want := mediaPlaylist{
+		TargetDuration: 4,
+		InitURI:        "init.mp4",
+		Segments:       []mediaSegment{{URI: "seg_00000.m4s", Duration: 4.004}, {URI: "seg_00001.m4s", Duration: 1.5}},
+		EndList:        true,
+	}
+	if !reflect.DeepEqual(playlist, want) {
+		t.Errorf("readMediaPlaylist = %+v, want %+v", playlist, want)
+	}
+
+	for name, raw := range map[string]string{
+		"no segments":  "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-ENDLIST\n",
+		"no duration":  "#EXTM3U\nseg_00000.m4s\n",
+		"bad duration": "#EXTM3U\n#EXTINF:four,\nseg_00000.m4s\n",
+		"bad target":   "#EXTM3U\n#EXT-X-TARGETDURATION:4.5\n#EXTINF:4,\nseg_00000.m4s\n",
+	} {
+		if _, err := readMediaPlaylist(strings.NewReader(raw), name); err == nil {
+			t.Errorf("%s: readMediaPlaylist succeeded, want an error", name)
+		}
+	}
+}
+
+func TestMeasureBandwidth(t *testing.T) {
+	playlist := mediaPlaylist{Segments: []mediaSegment{
+		{URI: "seg_00000.m4s", Duration: 4},
+		{URI: "seg_00001.m4s", Duration: 2},
+	}}
+
+	tests := []struct {
+		name          string
+		playlist      mediaPlaylist
+		sizes         map[string]int64
+		peak, average int
+		ok            bool
+	}{
+		{
+			"peak and average",
+			playlist,
+			map[string]int64{"seg_00000.m4s": 1000000, "seg_00001.m4s": 1000000},
+			// 4 Mbit/s for the short segment, 16 Mbit over 6 s rounded up
+			4000000, 2666667, true,
+		},
+		{
+			"extra sizes are ignored",
+			playlist,
+			map[string]int64{"seg_00000.m4s": 500000, "seg_00001.m4s": 250000, "init.mp4": 900},
+			1000000, 1000000, true,
+		},
+		{"missing size", playlist, map[string]int64{"seg_00000.m4s": 1000000}, 0, 0, false},
+		{
+			"zero duration",
+			mediaPlaylist{Segments: []mediaSegment{{URI: "seg_00000.m4s"}}},
+			map[string]int64{"seg_00000.m4s": 1000000},
+			0, 0, false,
+		},
+		{"no segments", mediaPlaylist{}, nil, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak, average, ok := measureBandwidth(tt.playlist, tt.sizes)
+			if peak != tt.peak || average != tt.average || ok != tt.ok {
+				t.Errorf("measureBandwidth = %d, %d, %v; want %d, %d, %v", peak, average, ok, tt.peak, tt.average, tt.ok)
+			}
+		})
+	}
+}
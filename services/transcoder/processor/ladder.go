@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+)
+
+// planRenditions drops the rungs that would upscale the source and sizes the
+// rest to fit inside their bounding box while keeping the source aspect ratio.
+// The box follows the source orientation, so the 1080p rung of a 9:16 phone
+// video is at most 1080x1920 rather than being squashed into 1920x1080.
+// The smallest rung is always kept so every upload gets at least one rendition.
+func planRenditions(ladder []renditionSpec, source videoProbe) []renditionSpec {
+	smallest := 0
+	var planned []renditionSpec
+	for i, r := range ladder {
+		if r.Width*r.Height < ladder[smallest].Width*ladder[smallest].Height {
+			smallest = i
+		}
+		if fitFactor(r, source) <= 1 {
+			planned = append(planned, fitToSource(r, source))
+		}
+	}
+
+	if len(planned) == 0 {
+		planned = append(planned, fitToSource(ladder[smallest], source))
+	}
+	return planned
+}
+
+// fitFactor is how much the source has to be scaled to fit the rung's box;
+// anything above 1 means the rung would upscale.
+func fitFactor(r renditionSpec, source videoProbe) float64 {
+	boxLong, boxShort := max(r.Width, r.Height), min(r.Width, r.Height)
+	sourceLong, sourceShort := max(source.Width, source.Height), min(source.Width, source.Height)
+
+	return math.Min(
+		float64(boxLong)/float64(sourceLong),
+		float64(boxShort)/float64(sourceShort),
+	)
+}
+
+// fitToSource sets the rendition's output size to the largest even size that
+// fits its box with the source aspect ratio, never exceeding the source size.
+func fitToSource(r renditionSpec, source videoProbe) renditionSpec {
+	factor := math.Min(fitFactor(r, source), 1)
+
+	r.Width = evenDimension(float64(source.Width) * factor)
+	r.Height = evenDimension(float64(source.Height) * factor)
+	return r
+}
+
+// evenDimension rounds to the nearest even pixel count, as yuv420p requires.
+func evenDimension(v float64) int {
+	return max(2, int(math.Round(v/2))*2)
+}
+
+// videoFilter converts a rung to its constant frame rate and scales it to its
+// size, tone mapping HDR sources when the rung is SDR.
+func videoFilter(r renditionSpec) string {
+	filter := fmt.Sprintf("scale=%d:%d,setsar=1", r.Width, r.Height)
+	if r.FrameRate.Num > 0 {
+		filter = "fps=" + r.FrameRate.String() + "," + filter
+	}
+	if r.Tonemap {
+		filter += "," + tonemapFilter
+	}
+	return filter
+}
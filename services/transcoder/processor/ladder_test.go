@@ -0,0 +1,49 @@
+package processor
+
+import "testing"
+
+func TestFitToSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		rung          renditionSpec
+		source        videoProbe
+		width, height int
+	}{
+		{"downscale", renditionSpec{Width: 1920, Height: 1080}, videoProbe{Width: 3840, Height: 2160}, 1920, 1080},
+		{"portrait source", renditionSpec{Width: 1280, Height: 720}, videoProbe{Width: 1080, Height: 1920}, 720, 1280},
+		{"narrower source", renditionSpec{Width: 1280, Height: 720}, videoProbe{Width: 1440, Height: 1080}, 960, 720},
+		{"never upscales", renditionSpec{Width: 1280, Height: 720}, videoProbe{Width: 640, Height: 360}, 640, 360},
+		{"rounds to even", renditionSpec{Width: 854, Height: 480}, videoProbe{Width: 1000, Height: 562}, 854, 480},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitToSource(tt.rung, tt.source)
+			if got.Width != tt.width || got.Height != tt.height {
+				t.Errorf("fitToSource = %dx%d, want %dx%d", got.Width, got.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestPlanRenditions(t *testing.T) {
+	ladder := builtinProfiles().profiles[defaultProfileName].Renditions
+
+	planned := planRenditions(ladder, videoProbe{Width: 1280, Height: 720})
+	if len(planned) != 2 || planned[0].Name != "720p" || planned[1].Name != "480p" {
+		t.Errorf("720p source planned %v, want 720p and 480p", names(planned))
+	}
+
+	// a source below every rung still gets the smallest one, at its own size
+	planned = planRenditions(ladder, videoProbe{Width: 320, Height: 240})
+	if len(planned) != 1 || planned[0].Name != "480p" || planned[0].Width != 320 || planned[0].Height != 240 {
+		t.Errorf("240p source planned %+v, want 480p at 320x240", planned)
+	}
+}
+
+func names(renditions []renditionSpec) []string {
+	var out []string
+	for _, r := range renditions {
+		out = append(out, r.Name)
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+	"go.uber.org/zap"
+)
+
+// silenceThreshold is the loudness, in LUFS, below which a track is treated
+// as silent and left alone; gaining up silence only amplifies noise.
+const silenceThreshold = -70
+
+// LoudnessOptions configures EBU R128 loudness normalization of the audio.
+type LoudnessOptions struct {
+	Enabled bool
+	// Target is the integrated loudness to normalize to, in LUFS.
+	Target float64
+	// TruePeak is the highest true peak allowed, in dBTP.
+	TruePeak float64
+	// Range is the target loudness range, in LU.
+	Range float64
+}
+
+// loudnessMeasurement is the first-pass analysis of ffmpeg's loudnorm filter.
+type loudnessMeasurement struct {
+	Integrated float64
+	TruePeak   float64
+	Range      float64
+	Threshold  float64
+	// Offset is the gain loudnorm suggests to apply after normalization.
+	Offset float64
+}
+
+// loudnorm is the second-pass filter of one audio rendition: the targets and
+// what the first pass measured.
+type loudnorm struct {
+	LoudnessOptions
+	Measured loudnessMeasurement
+}
+
+// filter builds the second pass of loudnorm. Linear mode applies one gain to
+// the whole track, so dynamics are kept whenever the target can be reached
+// without breaking the true peak limit.
+func (l loudnorm) filter() string {
+	return fmt.Sprintf(
+		"loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:offset=%g:linear=true",
+		l.Target, l.TruePeak, l.Range,
+		l.Measured.Integrated, l.Measured.TruePeak, l.Measured.Range, l.Measured.Threshold, l.Measured.Offset,
+	)
+}
+
+// measureLoudness runs the first loudnorm pass over source audio stream
+// 0:a:<streamIndex> and parses the JSON summary it prints at the end.
+func measureLoudness(ctx context.Context, videoPath string, streamIndex int, opts LoudnessOptions, slots FfmpegSlots) (loudnessMeasurement, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-nostats", "-loglevel", "info",
+		"-i", videoPath,
+		"-map", fmt.Sprintf("0:a:%d", streamIndex), "-vn", "-sn",
+		"-af", fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", opts.Target, opts.TruePeak, opts.Range),
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := slots.run(ctx, cmd); err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("loudnorm analysis: %w\n%s", err, stderr.String())
+	}
+	return parseLoudnormSummary(stderr.Bytes())
+}
+
+// parseLoudnormSummary reads the JSON object loudnorm logs after its
+// "Parsed_loudnorm" banner. The values are strings and can be "-inf" for
+// silent input.
+func parseLoudnormSummary(output []byte) (loudnessMeasurement, error) {
+	start := bytes.LastIndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return loudnessMeasurement{}, fmt.Errorf("no loudnorm summary in ffmpeg output")
+	}
+
+	var summary struct {
+		InputI       string `json:"input_i"`
+		InputTP      string `json:"input_tp"`
+		InputLRA     string `json:"input_lra"`
+		InputThresh  string `json:"input_thresh"`
+		TargetOffset string `json:"target_offset"`
+	}
+	if err := json.Unmarshal(output[start:end+1], &summary); err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("parse loudnorm summary: %w", err)
+	}
+
+	var m loudnessMeasurement
+	for _, field := range []struct {
+		dst *float64
+		raw string
+	}{
+		{&m.Integrated, summary.InputI},
+		{&m.TruePeak, summary.InputTP},
+		{&m.Range, summary.InputLRA},
+		{&m.Threshold, summary.InputThresh},
+		{&m.Offset, summary.TargetOffset},
+	} {
+		v, err := strconv.ParseFloat(field.raw, 64)
+		if err != nil {
+			return loudnessMeasurement{}, fmt.Errorf("parse loudnorm value %q: %w", field.raw, err)
+		}
+		*field.dst = v
+	}
+	return m, nil
+}
+
+// planLoudness measures every audio rendition and sets up its normalization.
+// A track that can't be measured or is silent is encoded as it is, so the
+// result reports for each track whether it was normalized.
+func planLoudness(ctx context.Context, videoPath string, specs []audioSpec, opts LoudnessOptions, slots FfmpegSlots, logger *zap.Logger) []types.AudioLoudness {
+	if !opts.Enabled {
+		return nil
+	}
+
+	report := make([]types.AudioLoudness, 0, len(specs))
+	for i := range specs {
+		log := logger.With(zap.String("rendition", specs[i].renditionName()))
+		entry := types.AudioLoudness{Rendition: specs[i].renditionName(), Target: opts.Target}
+
+		measured, err := measureLoudness(ctx, videoPath, specs[i].StreamIndex, opts, slots)
+		switch {
+		case err != nil:
+			log.Warn("loudness analysis failed, audio is not normalized", zap.Error(err))
+		case math.IsInf(measured.Integrated, -1) || measured.Integrated < silenceThreshold:
+			log.Info("audio is silent, not normalizing", zap.Float64("integrated", measured.Integrated))
+		default:
+			specs[i].Loudnorm = &loudnorm{LoudnessOptions: opts, Measured: measured}
+			entry.Integrated = measured.Integrated
+			entry.TruePeak = measured.TruePeak
+			entry.Range = measured.Range
+			entry.Threshold = measured.Threshold
+			entry.Normalized = true
+			log.Info("loudness measured",
+				zap.Float64("integrated", measured.Integrated),
+				zap.Float64("truePeak", measured.TruePeak),
+				zap.Float64("range", measured.Range))
+		}
+		report = append(report, entry)
+	}
+	return report
+}
@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLoudnormSummary(t *testing.T) {
+	output := `size=N/A time=00:01:00.00 bitrate=N/A speed= 412x
+[Parsed_loudnorm_0 @ 0x5581c0a4e2c0]
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-16.58",
+	"output_tp" : "-1.50",
+	"output_lra" : "14.78",
+	"output_thresh" : "-27.71",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.58"
+}
+`
+	got, err := parseLoudnormSummary([]byte(output))
+	if err != nil {
+		t.Fatalf("parseLoudnormSummary: %v", err)
+	}
+	want := loudnessMeasurement{Integrated: -27.61, TruePeak: -4.47, Range: 18.06, Threshold: -39.2, Offset: 0.58}
+	if got != want {
+		t.Errorf("parseLoudnormSummary = %+v, want %+v", got, want)
+	}
+
+	silent := `{"input_i" : "-inf", "input_tp" : "-inf", "input_lra" : "0.00", "input_thresh" : "-inf", "target_offset" : "inf"}`
+	got, err = parseLoudnormSummary([]byte(silent))
+	if err != nil {
+		t.Fatalf("parseLoudnormSummary of silence: %v", err)
+	}
+	if !math.IsInf(got.Integrated, -1) {
+		t.Errorf("integrated loudness of silence = %v, want -inf", got.Integrated)
+	}
+
+	for name, output := range map[string]string{
+		"no summary":    "Error while filtering: Invalid argument\n",
+		"bad json":      `{"input_i" : -27.61,}`,
+		"bad value":     `{"input_i" : "loud", "input_tp" : "-4.47", "input_lra" : "18.06", "input_thresh" : "-39.20", "target_offset" : "0.58"}`,
+		"missing value": `{"input_i" : "-27.61"}`,
+	} {
+		if _, err := parseLoudnormSummary([]byte(output)); err == nil {
+			t.Errorf("%s: parseLoudnormSummary succeeded, want an error", name)
+		}
+	}
+}
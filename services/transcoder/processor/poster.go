@@ -0,0 +1,213 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/png"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+const (
+	// posterCandidates is how many points of the video are considered.
+	posterCandidates = 12
+	// posterChoices is the best candidate plus the alternates offered to the uploader.
+	posterChoices = 4
+	// posterWindowSeconds is the stretch after each point the thumbnail filter
+	// picks its most representative frame from.
+	posterWindowSeconds = 3
+)
+
+// posterWidths are the sizes every chosen poster is published at, largest first.
+var posterWidths = []int{1280, 640, 320}
+
+// posterCandidate is one frame considered for the poster.
+type posterCandidate struct {
+	Time   float64
+	Path   string // lossless PNG, at most posterWidths[0] wide
+	Width  int
+	Height int
+	Score  float64
+}
+
+// generatePosters picks the best poster frames of the video and uploads each
+// at every posterWidths size as JPEG and WebP. Candidates are spread over the
+// whole video, each the most representative frame of a short window (which
+// steers clear of transitions), then scored by sharpness, contrast and
+// exposure so black, washed out and motion blurred frames lose. The best
+// poster comes first.
+func generatePosters(
+	ctx context.Context,
+	uploader *s3manager.Uploader,
+	bucket, stagingDir, keyPrefix, videoPath string,
+	source videoProbe,
+	slots FfmpegSlots,
+	logger *zap.Logger,
+) ([]types.Poster, error) {
+	posterDir := filepath.Join(stagingDir, "posters")
+	if err := os.MkdirAll(posterDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var candidates []posterCandidate
+	for i := 0; i < posterCandidates; i++ {
+		// stay clear of fade-ins and end cards
+		at := source.Duration * (0.05 + 0.9*float64(i)/float64(posterCandidates-1))
+		candidate, err := extractPosterCandidate(ctx, videoPath, posterDir, i, at, source, slots)
+		if err != nil {
+			logger.Warn("poster candidate failed", zap.Float64("time", at), zap.Error(err))
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no poster candidate could be extracted")
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	chosen := candidates[:min(posterChoices, len(candidates))]
+
+	posters := make([]types.Poster, 0, len(chosen))
+	for rank, candidate := range chosen {
+		poster := types.Poster{Time: candidate.Time}
+		for _, width := range posterSizes(candidate.Width) {
+			height := evenDimension(float64(width) * float64(candidate.Height) / float64(candidate.Width))
+			base := filepath.Join(posterDir, fmt.Sprintf("%d_%d", rank, width))
+
+			cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", candidate.Path,
+				"-vf", fmt.Sprintf("scale=%d:%d", width, height), "-q:v", "2", base+".jpg",
+				"-vf", fmt.Sprintf("scale=%d:%d", width, height), "-c:v", "libwebp", "-quality", "80", base+".webp")
+			cmd.Stderr = os.Stderr
+			if err := slots.run(ctx, cmd); err != nil {
+				return nil, fmt.Errorf("encode poster %d at %dpx: %w", rank, width, err)
+			}
+
+			for _, format := range []string{"jpg", "webp"} {
+				key := path.Join(keyPrefix, fmt.Sprintf("%d", rank), fmt.Sprintf("%d.%s", width, format))
+				if err := uploadFile(ctx, uploader, bucket, key, base+"."+format, "public, max-age=31536000, immutable", logger); err != nil {
+					return nil, err
+				}
+				poster.Images = append(poster.Images, types.PosterImage{Key: key, Width: width, Height: height, Format: format})
+			}
+		}
+		posters = append(posters, poster)
+	}
+
+	logger.Info("posters uploaded",
+		zap.Int("candidates", len(candidates)),
+		zap.Float64("bestTime", chosen[0].Time),
+		zap.Float64("bestScore", chosen[0].Score))
+	return posters, nil
+}
+
+// extractPosterCandidate grabs the most representative frame of the window
+// starting at at and scores it. HDR frames are tone mapped here, so the
+// scoring and every size encoded from the candidate see SDR.
+func extractPosterCandidate(ctx context.Context, videoPath, dir string, index int, at float64, source videoProbe, slots FfmpegSlots) (posterCandidate, error) {
+	width := evenDimension(float64(min(posterWidths[0], source.Width)))
+	height := evenDimension(float64(width) * float64(source.Height) / float64(source.Width))
+	framePath := filepath.Join(dir, fmt.Sprintf("candidate_%02d.png", index))
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y",
+		"-ss", fmt.Sprintf("%.3f", at), "-t", fmt.Sprint(posterWindowSeconds), "-i", videoPath,
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("thumbnail,scale=%d:%d,setsar=1", width, height)+sdrFilter(source),
+		"-frames:v", "1", framePath)
+	cmd.Stderr = os.Stderr
+	if err := slots.run(ctx, cmd); err != nil {
+		return posterCandidate{}, fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	f, err := os.Open(framePath)
+	if err != nil {
+		return posterCandidate{}, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return posterCandidate{}, fmt.Errorf("decode frame: %w", err)
+	}
+
+	return posterCandidate{
+		Time:   at,
+		Path:   framePath,
+		Width:  width,
+		Height: height,
+		Score:  scoreFrame(img),
+	}, nil
+}
+
+// posterSizes returns the posterWidths that don't upscale a frame width
+// pixels wide, or the frame's own width if it is smaller than all of them.
+func posterSizes(width int) []int {
+	var sizes []int
+	for _, w := range posterWidths {
+		if w <= width {
+			sizes = append(sizes, w)
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = append(sizes, width)
+	}
+	return sizes
+}
+
+// scoreFrame rates how good a poster img would make. Sharpness is the
+// variance of the Laplacian of the luma; it is scaled down for flat, low
+// contrast frames and heavily penalised for near-black or near-white ones.
+func scoreFrame(img image.Image) float64 {
+	bounds := img.Bounds()
+	// 320 columns are plenty to judge a frame and keep scoring cheap
+	step := max(1, bounds.Dx()/320)
+	cols, rows := bounds.Dx()/step, bounds.Dy()/step
+	if cols < 3 || rows < 3 {
+		return 0
+	}
+
+	luma := make([]float64, cols*rows)
+	var sum float64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x*step, bounds.Min.Y+y*step).RGBA()
+			l := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			luma[y*cols+x] = l
+			sum += l
+		}
+	}
+	mean := sum / float64(len(luma))
+
+	var spread float64
+	for _, l := range luma {
+		spread += (l - mean) * (l - mean)
+	}
+	stddev := math.Sqrt(spread / float64(len(luma)))
+
+	var lapSum, lapSquares float64
+	n := 0
+	for y := 1; y < rows-1; y++ {
+		for x := 1; x < cols-1; x++ {
+			i := y*cols + x
+			lap := luma[i-1] + luma[i+1] + luma[i-cols] + luma[i+cols] - 4*luma[i]
+			lapSum += lap
+			lapSquares += lap * lap
+			n++
+		}
+	}
+	lapMean := lapSum / float64(n)
+	sharpness := lapSquares/float64(n) - lapMean*lapMean
+
+	score := sharpness * math.Min(1, stddev/48)
+	if mean < 24 || mean > 232 {
+		score *= 0.05
+	}
+	return score
+}
@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+const (
+	// previewSegments clips, each previewSegmentSeconds long, are stitched into
+	// the hover preview of videos long enough to have them.
+	previewSegments       = 4
+	previewSegmentSeconds = 1.5
+	// previewFrameRate keeps the animated WebP small; the MP4 matches it.
+	previewFrameRate = 12
+)
+
+// previewBox bounds the preview size, following the source orientation.
+var previewBox = renditionSpec{Width: 480, Height: 270}
+
+// previewKeys are the S3 keys of the hover preview in both formats.
+type previewKeys struct {
+	MP4  string
+	WebP string
+}
+
+// previewClips returns the start of each clip and the clip length. Videos too
+// short for several clips get a single clip from the start.
+func previewClips(duration float64) ([]float64, float64) {
+	total := previewSegments * previewSegmentSeconds
+	if duration < total*2 {
+		return []float64{0}, min(total, duration)
+	}
+
+	starts := make([]float64, previewSegments)
+	for i := range starts {
+		// evenly spread between 10% and 90%, skipping intros and end cards
+		starts[i] = duration * (0.1 + 0.8*float64(i)/float64(previewSegments-1))
+		starts[i] = min(starts[i], duration-previewSegmentSeconds)
+	}
+	return starts, previewSegmentSeconds
+}
+
+// generatePreview stitches short clips from across the video into a muted
+// looping preview, encoded as MP4 and animated WebP, and uploads both under
+// keyPrefix.
+func generatePreview(
+	ctx context.Context,
+	uploader *s3manager.Uploader,
+	bucket, stagingDir, keyPrefix, videoPath string,
+	source videoProbe,
+	slots FfmpegSlots,
+	logger *zap.Logger,
+) (previewKeys, error) {
+	previewDir := filepath.Join(stagingDir, "preview")
+	if err := os.MkdirAll(previewDir, 0755); err != nil {
+		return previewKeys{}, err
+	}
+
+	starts, length := previewClips(source.Duration)
+	size := fitToSource(previewBox, source)
+
+	tonemap := sdrFilter(source)
+
+	var args []string
+	var filters, labels []string
+	for i, start := range starts {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", length), "-i", videoPath)
+		filters = append(filters, fmt.Sprintf("[%d:v:0]fps=%d,scale=%d:%d,setsar=1%s[c%d]", i, previewFrameRate, size.Width, size.Height, tonemap, i))
+		labels = append(labels, fmt.Sprintf("[c%d]", i))
+	}
+	filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=0,split=2[mp4][webp]", strings.Join(labels, ""), len(starts)))
+
+	mp4Path := filepath.Join(previewDir, "preview.mp4")
+	webpPath := filepath.Join(previewDir, "preview.webp")
+	args = append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[mp4]", "-an",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "28", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart", mp4Path,
+		"-map", "[webp]", "-an",
+		"-c:v", "libwebp", "-quality", "60", "-loop", "0", webpPath,
+	)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-y"}, args...)...)
+	cmd.Stderr = os.Stderr
+	if err := slots.run(ctx, cmd); err != nil {
+		return previewKeys{}, fmt.Errorf("ffmpeg preview: %w", err)
+	}
+
+	keys := previewKeys{
+		MP4:  path.Join(keyPrefix, "preview.mp4"),
+		WebP: path.Join(keyPrefix, "preview.webp"),
+	}
+	if err := uploadFile(ctx, uploader, bucket, keys.MP4, mp4Path, "public, max-age=31536000, immutable", logger); err != nil {
+		return previewKeys{}, err
+	}
+	if err := uploadFile(ctx, uploader, bucket, keys.WebP, webpPath, "public, max-age=31536000, immutable", logger); err != nil {
+		return previewKeys{}, err
+	}
+
+	logger.Info("preview uploaded", zap.Int("clips", len(starts)), zap.Float64("clipSeconds", length))
+	return keys, nil
+}
@@ -0,0 +1,319 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+)
+
+// videoProbe is the subset of ffprobe output the transcoder cares about.
+type videoProbe struct {
+	Duration float64
+	// Width and Height are the display size, i.e. the coded size with the
+	// sample aspect ratio applied so anamorphic sources aren't squashed, and
+	// swapped when the source is rotated by 90 or 270 degrees.
+	Width  int
+	Height int
+	// FrameRate is the average frame rate of the video stream, 0 if unknown
+	FrameRate float64
+	// AudioStreams lists every audio stream in file order, so entry i is 0:a:i
+	AudioStreams []audioStream
+	// Metadata is the full probe result published with the status event
+	Metadata types.MediaMetadata
+}
+
+// audioStream is one audio stream of the source with its tags and dispositions.
+type audioStream struct {
+	Language       string // ISO 639-2 as tagged, e.g. "eng"; "" when untagged
+	Title          string
+	Channels       int
+	Default        bool
+	Commentary     bool
+	VisualImpaired bool // audio description
+}
+
+// probeVideo runs ffprobe once and returns the container duration together
+// with the display dimensions of the first video stream and every audio stream.
+func probeVideo(ctx context.Context, videoPath string) (videoProbe, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		videoPath,
+	)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return videoProbe{}, &toolError{Err: err, Stderr: stderr.String()}
+	}
+
+	var probe struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			Size       string `json:"size"`
+			BitRate    string `json:"bit_rate"`
+			Tags       struct {
+				CreationTime string `json:"creation_time"`
+			} `json:"tags"`
+		} `json:"format"`
+		Streams []probeStream `json:"streams"`
+	}
+
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		return videoProbe{}, err
+	}
+
+	dur, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return videoProbe{}, err
+	}
+
+	video := -1
+	var audioStreams []audioStream
+	var audioMetadata []types.AudioMetadata
+	for i, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// cover art shows up as a video stream too
+			if video < 0 && stream.Disposition.AttachedPic == 0 {
+				video = i
+			}
+		case "audio":
+			language := strings.ToLower(stream.Tags.Language)
+			if language == "und" {
+				language = ""
+			}
+			audioStreams = append(audioStreams, audioStream{
+				Language:       language,
+				Title:          strings.TrimSpace(stream.Tags.Title),
+				Channels:       stream.Channels,
+				Default:        stream.Disposition.Default == 1,
+				Commentary:     stream.Disposition.Comment == 1,
+				VisualImpaired: stream.Disposition.VisualImpaired == 1,
+			})
+			audioMetadata = append(audioMetadata, types.AudioMetadata{
+				Codec:         stream.CodecName,
+				Language:      language,
+				Channels:      stream.Channels,
+				ChannelLayout: stream.ChannelLayout,
+				SampleRate:    atoiOrZero(stream.SampleRate),
+				Bitrate:       atoiOrZero(stream.BitRate),
+			})
+		}
+	}
+
+	if video < 0 || probe.Streams[video].Width <= 0 || probe.Streams[video].Height <= 0 {
+		return videoProbe{}, errNoVideoStream
+	}
+	stream := probe.Streams[video]
+
+	width := stream.Width
+	if sar := parseRatio(stream.SampleAspectRatio); sar > 0 {
+		width = evenDimension(float64(stream.Width) * sar)
+	}
+
+	frameRate := parseRatio(stream.AvgFrameRate)
+	if frameRate == 0 {
+		frameRate = parseRatio(stream.RFrameRate)
+	}
+
+	rotation := stream.rotation()
+	displayWidth, displayHeight := width, stream.Height
+	if rotation == 90 || rotation == 270 {
+		displayWidth, displayHeight = displayHeight, displayWidth
+	}
+
+	size, _ := strconv.ParseInt(probe.Format.Size, 10, 64)
+	metadata := types.MediaMetadata{
+		Container:    probe.Format.FormatName,
+		Duration:     dur,
+		Bitrate:      atoiOrZero(probe.Format.BitRate),
+		Size:         size,
+		CreationTime: probe.Format.Tags.CreationTime,
+		Video: types.VideoMetadata{
+			Codec:          stream.CodecName,
+			Profile:        stream.Profile,
+			Width:          stream.Width,
+			Height:         stream.Height,
+			DisplayWidth:   displayWidth,
+			DisplayHeight:  displayHeight,
+			FrameRate:      frameRate,
+			Rotation:       rotation,
+			Bitrate:        atoiOrZero(stream.BitRate),
+			PixelFormat:    stream.PixFmt,
+			BitDepth:       stream.bitDepth(),
+			ColorPrimaries: stream.ColorPrimaries,
+			ColorTransfer:  stream.ColorTransfer,
+			ColorSpace:     stream.ColorSpace,
+			HDR:            stream.hdrFormat(),
+		},
+		Audio: audioMetadata,
+	}
+
+	return videoProbe{
+		Duration:     dur,
+		Width:        displayWidth,
+		Height:       displayHeight,
+		FrameRate:    frameRate,
+		AudioStreams: audioStreams,
+		Metadata:     metadata,
+	}, nil
+}
+
+// probeStream is one entry of ffprobe's -show_streams output.
+type probeStream struct {
+	CodecType         string `json:"codec_type"`
+	CodecName         string `json:"codec_name"`
+	Profile           string `json:"profile"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	SampleAspectRatio string `json:"sample_aspect_ratio"`
+	AvgFrameRate      string `json:"avg_frame_rate"`
+	RFrameRate        string `json:"r_frame_rate"`
+	PixFmt            string `json:"pix_fmt"`
+	BitsPerRawSample  string `json:"bits_per_raw_sample"`
+	ColorPrimaries    string `json:"color_primaries"`
+	ColorTransfer     string `json:"color_transfer"`
+	ColorSpace        string `json:"color_space"`
+	BitRate           string `json:"bit_rate"`
+	Channels          int    `json:"channels"`
+	ChannelLayout     string `json:"channel_layout"`
+	SampleRate        string `json:"sample_rate"`
+	Disposition       struct {
+		Default        int `json:"default"`
+		Comment        int `json:"comment"`
+		VisualImpaired int `json:"visual_impaired"`
+		AttachedPic    int `json:"attached_pic"`
+	} `json:"disposition"`
+	Tags struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+		Rotate   string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// rotation returns the clockwise rotation, 0, 90, 180 or 270, a player has to
+// apply to show the stream upright. Newer ffmpeg reports it as display matrix
+// side data (counter-clockwise), older builds as the rotate tag.
+func (s probeStream) rotation() int {
+	degrees := 0.0
+	for _, side := range s.SideDataList {
+		if side.SideDataType == "Display Matrix" {
+			degrees = -side.Rotation
+		}
+	}
+	if degrees == 0 {
+		degrees, _ = strconv.ParseFloat(s.Tags.Rotate, 64)
+	}
+	return ((int(math.Round(degrees/90))*90)%360 + 360) % 360
+}
+
+// bitDepth returns the bits per sample of the stream, 0 if unknown.
+func (s probeStream) bitDepth() int {
+	if bits := atoiOrZero(s.BitsPerRawSample); bits > 0 {
+		return bits
+	}
+	switch {
+	case strings.Contains(s.PixFmt, "p10"):
+		return 10
+	case strings.Contains(s.PixFmt, "p12"):
+		return 12
+	case s.PixFmt != "":
+		return 8
+	}
+	return 0
+}
+
+// hdrFormat names the HDR format of the stream, "" for SDR.
+func (s probeStream) hdrFormat() string {
+	for _, side := range s.SideDataList {
+		if side.SideDataType == "DOVI configuration record" {
+			return "DolbyVision"
+		}
+	}
+	switch s.ColorTransfer {
+	case "smpte2084":
+		return "PQ"
+	case "arib-std-b67":
+		return "HLG"
+	}
+	return ""
+}
+
+// atoiOrZero parses ffprobe's stringly typed numbers, "N/A" and all.
+func atoiOrZero(s string) int {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// probeDimensions returns the coded size of the first video stream in path.
+// It works on a bare init segment, which is all a CMAF rendition needs.
+func probeDimensions(ctx context.Context, path string) (int, int, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		path,
+	)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = io.Discard
+
+	if err := cmd.Run(); err != nil {
+		return 0, 0, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		return 0, 0, err
+	}
+	if len(probe.Streams) == 0 || probe.Streams[0].Width <= 0 || probe.Streams[0].Height <= 0 {
+		return 0, 0, fmt.Errorf("no video stream in %s", path)
+	}
+	return probe.Streams[0].Width, probe.Streams[0].Height, nil
+}
+
+// parseRatio parses ffprobe ratios such as "4:3" or "30000/1001". Unknown or
+// degenerate values ("0:1", "N/A") return 0.
+func parseRatio(s string) float64 {
+	num, den, ok := strings.Cut(s, ":")
+	if !ok {
+		num, den, ok = strings.Cut(s, "/")
+	}
+	if !ok {
+		return 0
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0
+	}
+	return n / d
+}
@@ -3,9 +3,8 @@ package processor
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -13,7 +12,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
 	"github.com/aws/aws-sdk-go/aws"
@@ -25,18 +23,85 @@ import (
 
 // defines the parameters for each video rendition.
 type renditionSpec struct {
-	Name       string
-	Scale      string
-	CRF        string // tells ffmpeg to aim for a certain visual quality level
-	MaxBitrate string
-	BufSize    string
-	Bandwidth  int
+	Name       string `yaml:"name" json:"name"`
+	Width      int    `yaml:"width" json:"width"`
+	Height     int    `yaml:"height" json:"height"`
+	CRF        int    `yaml:"crf" json:"crf"` // tells ffmpeg to aim for a certain visual quality level
+	MaxBitrate string `yaml:"maxBitrate" json:"maxBitrate"`
+	BufSize    string `yaml:"bufSize" json:"bufSize"`
+	Bandwidth  int    `yaml:"bandwidth" json:"bandwidth"`
+	// MaxFrameRate caps the rung's frame rate; faster sources are decimated
+	// to a half, quarter, ... of their rate. 0 means 60.
+	MaxFrameRate float64 `yaml:"maxFrameRate" json:"maxFrameRate"`
+	// FrameRate is the constant frame rate the rung is encoded at and
+	// KeyframeGrid the ladder's lowest one, which keyframes are aligned to.
+	FrameRate    frameRate `yaml:"-" json:"-"`
+	KeyframeGrid frameRate `yaml:"-" json:"-"`
+	// Codec is set on the rungs derived for a profile's additionalCodecs;
+	// empty means H.264.
+	Codec string `yaml:"-" json:"-"`
+	// VideoRange is PQ or HLG on the rungs that keep an HDR source's dynamic
+	// range; empty means SDR.
+	VideoRange string `yaml:"-" json:"-"`
+	// Tonemap maps an HDR source down to SDR BT.709 before encoding.
+	Tonemap bool `yaml:"-" json:"-"`
 }
 
-var renditions = []renditionSpec{
-	{Name: "1080p", Scale: "1920x1080", CRF: "32", MaxBitrate: "5000k", BufSize: "10000k", Bandwidth: 5000000},
-	{Name: "720p", Scale: "1280x720", CRF: "34", MaxBitrate: "3000k", BufSize: "6000k", Bandwidth: 3000000},
-	{Name: "480p", Scale: "854x480", CRF: "36", MaxBitrate: "1200k", BufSize: "2400k", Bandwidth: 1200000},
+// Options carries the service-wide settings that shape every transcode.
+type Options struct {
+	Profiles *Profiles
+	// Ffmpeg is shared by every Process call running at the same time and
+	// bounds their ffmpeg processes together.
+	Ffmpeg FfmpegSlots
+	// FfmpegThreads is passed to each encode as -threads; 0 lets ffmpeg decide.
+	FfmpegThreads int
+	Storyboard    StoryboardOptions
+	// Limits are enforced on every upload before it is transcoded.
+	Limits Limits
+	// QuarantinePrefix is where rejected uploads are copied to.
+	QuarantinePrefix string
+	// OverlayPrefix is where the watermark images requests name must be kept.
+	OverlayPrefix string
+	// Loudness normalizes every audio track when enabled.
+	Loudness LoudnessOptions
+	// Encryption encrypts every segment with a per-video key when enabled.
+	Encryption EncryptionOptions
+}
+
+// hlsSegmentSeconds is the target segment length shared by HLS and DASH.
+const hlsSegmentSeconds = 4
+
+// audioSampleRate is the sample rate every audio rendition is encoded at.
+const audioSampleRate = 48000
+
+// encodeJob is one ffmpeg run that produces one HLS media playlist in its
+// own directory. Exactly one of Video and Audio is set.
+type encodeJob struct {
+	Name  string
+	Args  []string
+	Video *renditionSpec
+	Audio *audioSpec
+	// NominalBandwidth is advertised if the segment sizes can't be measured
+	NominalBandwidth int
+	// Fingerprint ties a checkpointed rendition to the settings it was made with
+	Fingerprint string
+}
+
+// renditionOutput describes a rendition as it was actually produced.
+type renditionOutput struct {
+	Name      string
+	Spec      renditionSpec // zero for audio renditions
+	Audio     *audioSpec
+	Width     int
+	Height    int
+	FrameRate frameRate
+	Codecs    string
+	// VideoRange is SDR, PQ or HLG, as advertised in the master playlist
+	VideoRange string
+	// PeakBandwidth and AverageBandwidth are measured from the uploaded segments
+	PeakBandwidth    int
+	AverageBandwidth int
+	Playlist         mediaPlaylist
 }
 
 
@@ -44,6 +109,7 @@ func downloadVideoFromS3(
 	ctx context.Context,
 	downloader *s3manager.Downloader,
 	bucket, key, localPath string,
+	progress *progressTracker,
 	logger *zap.Logger,
 ) error {
 	logger.Info("downloading video from S3", zap.String("key", key), zap.String("localPath", localPath))
@@ -54,7 +120,18 @@ func downloadVideoFromS3(
 	}
 	defer file.Close()
 
-	_, err = downloader.DownloadWithContext(ctx, file, &s3.GetObjectInput{
+	// the size is only needed for progress, so a failed HEAD isn't fatal
+	var total int64
+	head, err := downloader.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && head.ContentLength != nil {
+		total = *head.ContentLength
+	}
+	writer := &progressWriterAt{w: file, total: total, onProgress: progress.setPercent}
+
+	_, err = downloader.DownloadWithContext(ctx, writer, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	}, func(d *s3manager.Downloader) {
@@ -75,13 +152,21 @@ func Process(
 	ctx context.Context,
 	request types.TranscodeRequest,
 	bucketName, transcodedPrefix string,
+	opts Options,
 	s3Client *s3.S3,
 	sess *session.Session,
+	report ProgressFunc,
 	logger *zap.Logger,
 ) (types.UpdateVideoStatusEvent, error) {
 	// Confirm that the Process function has been entered.
 	logger.Info("processor.Process function entered")
 
+	profile, err := opts.Profiles.lookup(request.Profile)
+	if err != nil {
+		return types.UpdateVideoStatusEvent{}, &ValidationError{Reason: ReasonUnknownProfile, Detail: request.Profile, Err: err}
+	}
+	renditions := profile.Renditions
+
 	stagingDir, err := os.MkdirTemp("", "transcoder-"+ request.VideoId)
 	if err != nil {
 		return types.UpdateVideoStatusEvent{}, fmt.Errorf("create staging directory: %w", err)
@@ -90,12 +175,14 @@ func Process(
 	defer os.RemoveAll(stagingDir)
 	
 	originalKey := fmt.Sprintf("%s/%s", "originals", request.S3Key)
-	thumbnailKey := path.Join(transcodedPrefix, request.VideoId, "thumbnails", "poster.jpg")
 
 	downloader := s3manager.NewDownloader(sess)
+	progress := newProgressTracker(request.VideoId, report)
+	defer progress.close()
+	progress.setStage(StageDownload)
 
 	localVideoPath := filepath.Join(stagingDir, "original_video")
-	if err := downloadVideoFromS3(ctx, downloader, bucketName, originalKey, localVideoPath, logger); err != nil {
+	if err := downloadVideoFromS3(ctx, downloader, bucketName, originalKey, localVideoPath, progress, logger); err != nil {
 		return types.UpdateVideoStatusEvent{}, fmt.Errorf("download video from S3: %w", err)
 	}
 	
@@ -105,12 +192,51 @@ func Process(
 		}
 	}()
 
-	duration, err := getVideoDuration(ctx, localVideoPath)
+	progress.setStage(StageProbe)
+	probe, err := validateSource(ctx, localVideoPath, opts.Limits)
 	if err != nil {
-		return types.UpdateVideoStatusEvent{}, fmt.Errorf("get video duration: %w", err)
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			quarantineKey := path.Join(opts.QuarantinePrefix, request.S3Key)
+			quarantineOriginal(ctx, s3Client, bucketName, originalKey, quarantineKey, invalid.Reason, logger)
+		}
+		return types.UpdateVideoStatusEvent{}, fmt.Errorf("validate video: %w", err)
 	}
+	duration := probe.Duration
+
+	logger.Info("video probed", zap.Float64("duration", duration), zap.Int("width", probe.Width), zap.Int("height", probe.Height))
 
-	logger.Info("video duration", zap.Float64("duration", duration))
+	renditions = planRenditions(renditions, probe)
+	ladder := &types.EncodingLadder{Profile: opts.Profiles.resolve(request.Profile), ContentAware: profile.ContentAware}
+	if profile.ContentAware {
+		renditions, ladder.Complexity = contentAwareLadder(ctx, localVideoPath, probe, renditions, opts.Ffmpeg, logger)
+	}
+	// HDR sources are tone mapped on every SDR rung; the HDR copies keep the range
+	sourceRange := sourceVideoRange(probe.Metadata.Video)
+	if sourceRange != videoRangeSDR {
+		for i := range renditions {
+			renditions[i].Tonemap = true
+		}
+	}
+	hdrRenditions := profile.hdrRenditions(renditions, sourceRange)
+	renditions = append(renditions, profile.codecRenditions(renditions)...)
+	renditions = append(renditions, hdrRenditions...)
+	planFrameRates(renditions, sourceFrameRate(probe.FrameRate))
+	for _, r := range renditions {
+		ladder.Rungs = append(ladder.Rungs, types.LadderRung{
+			Name:       r.Name,
+			Codec:      videoCodecName(r.Codec),
+			Width:      r.Width,
+			Height:     r.Height,
+			CRF:        r.CRF,
+			MaxBitrate: r.MaxBitrate,
+			Bandwidth:  r.Bandwidth,
+			FrameRate:  r.FrameRate.float(),
+			VideoRange: r.videoRange(),
+			Tonemap:    r.Tonemap,
+		})
+	}
+	logger.Info("renditions planned", zap.Int("count", len(renditions)))
 
 	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
 		u.PartSize = 10 * 1024 * 1024 // 10MB parts
@@ -118,230 +244,524 @@ func Process(
 	})
 
 	
-	thumbnailErrChan := make(chan error)
+	type posterResult struct {
+		posters []types.Poster
+		err     error
+	}
+	posterChan := make(chan posterResult, 1)
+	go func() {
+		posterPrefix := path.Join(transcodedPrefix, request.VideoId, "thumbnails", "posters")
+		posters, err := generatePosters(ctx, uploader, bucketName, stagingDir, posterPrefix, localVideoPath, probe, opts.Ffmpeg, logger)
+		posterChan <- posterResult{posters, err}
+	}()
+
+	// Storyboards only power seek-bar previews, so a failure is logged and the
+	// video is published without one.
+	storyboardKeyChan := make(chan string, 1)
+	go func() {
+		if opts.Storyboard.Interval <= 0 {
+			storyboardKeyChan <- ""
+			return
+		}
+		storyboardPrefix := path.Join(transcodedPrefix, request.VideoId, "thumbnails", "storyboard")
+		key, err := generateStoryboard(ctx, uploader, bucketName, stagingDir, storyboardPrefix, localVideoPath, opts.Storyboard, probe, opts.Ffmpeg, logger)
+		if err != nil {
+			logger.Warn("storyboard generation failed", zap.Error(err))
+		}
+		storyboardKeyChan <- key
+	}()
+
+	// likewise the hover preview is a nice-to-have
+	previewChan := make(chan previewKeys, 1)
 	go func() {
-		thumbnailErrChan <- generateThumbnail(ctx, uploader, bucketName, stagingDir, thumbnailKey, localVideoPath, duration, logger)
+		previewPrefix := path.Join(transcodedPrefix, request.VideoId, "thumbnails")
+		keys, err := generatePreview(ctx, uploader, bucketName, stagingDir, previewPrefix, localVideoPath, probe, opts.Ffmpeg, logger)
+		if err != nil {
+			logger.Warn("preview generation failed", zap.Error(err))
+		}
+		previewChan <- keys
 	}()
 
-	var failedRenditions []renditionSpec
-	var successRenditions []renditionSpec
+	audioSpecs := planAudioRenditions(probe.AudioStreams, profile)
+	loudness := planLoudness(ctx, localVideoPath, audioSpecs, opts.Loudness, opts.Ffmpeg, logger)
+
+	mark, err := prepareWatermark(ctx, s3Client, bucketName, opts.OverlayPrefix, stagingDir, request.Overlay)
+	if err != nil {
+		return types.UpdateVideoStatusEvent{}, fmt.Errorf("prepare watermark: %w", err)
+	}
+
+	var keyInfo, keyURL string
+	if opts.Encryption.enabled() {
+		key, err := opts.Encryption.Keys.ContentKey(ctx, request.VideoId)
+		if err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("get content key: %w", err)
+		}
+		keyURL = opts.Encryption.keyURL(request.VideoId)
+		keyInfo, err = writeKeyInfo(stagingDir, key, keyURL)
+		if err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("prepare encryption: %w", err)
+		}
+	}
+
+	jobs := make([]encodeJob, 0, len(renditions)+len(audioSpecs))
 	for _, r := range renditions {
-		if err := processSingleRendition(ctx, uploader, bucketName, localVideoPath, transcodedPrefix, request.VideoId, r, stagingDir, logger); err != nil {
-			logger.Error("rendition failed, continuing with others", zap.String("rendition", r.Name), zap.Error(err))
-			failedRenditions = append(failedRenditions, r)
+		jobs = append(jobs, videoEncodeJob(r, localVideoPath, opts.FfmpegThreads, keyInfo, mark))
+	}
+	for _, a := range audioSpecs {
+		jobs = append(jobs, audioEncodeJob(a, localVideoPath, opts.FfmpegThreads, keyInfo))
+	}
+	for i := range jobs {
+		jobs[i].Fingerprint = jobFingerprint(jobs[i], originalKey, localVideoPath)
+	}
+
+	// a redelivered request picks up where the previous attempt got to
+	checkpoints := loadCheckpoint(ctx, s3Client, bucketName, transcodedPrefix, request.VideoId, logger)
+
+	// Encode renditions concurrently, bounded by the ffmpeg slots shared with
+	// the other videos so the node isn't oversubscribed.
+	progress.setStage(StageEncode)
+	for _, job := range jobs {
+		progress.setRendition(job.Name, 0)
+	}
+	outputs := make([]renditionOutput, len(jobs))
+	renditionErrs := make([]error, len(jobs))
+	var encodeWg sync.WaitGroup
+	for i, job := range jobs {
+		encodeWg.Add(1)
+		go func(i int, job encodeJob) {
+			defer encodeWg.Done()
+			if output, ok := checkpoints.completed(job.Name, job.Fingerprint); ok {
+				logger.Info("rendition already complete, skipping encode", zap.String("rendition", job.Name))
+				progress.setRendition(job.Name, 100)
+				outputs[i] = output
+				return
+			}
+
+			if err := opts.Ffmpeg.acquire(ctx); err != nil {
+				renditionErrs[i] = err
+				return
+			}
+			defer opts.Ffmpeg.release()
+			outputs[i], renditionErrs[i] = runEncodeJob(ctx, uploader, bucketName, transcodedPrefix, request.VideoId, job, stagingDir, duration, progress, logger)
+			if renditionErrs[i] == nil {
+				checkpoints.record(ctx, job.Name, job.Fingerprint, outputs[i])
+			}
+		}(i, job)
+	}
+	encodeWg.Wait()
+
+	var failedRenditions []string
+	var successRenditions []renditionOutput
+	var audioRenditions []renditionOutput
+	for i, job := range jobs {
+		if renditionErrs[i] != nil {
+			if job.Audio != nil {
+				// video renditions are silent, so a missing audio track can't be papered over
+				return types.UpdateVideoStatusEvent{}, fmt.Errorf("audio rendition %s failed: %w", job.Name, renditionErrs[i])
+			}
+			logger.Error("rendition failed, continuing with others", zap.String("rendition", job.Name), zap.Error(renditionErrs[i]))
+			failedRenditions = append(failedRenditions, job.Name)
 			continue
 		}
-		logger.Info("rendition completed successfully", zap.String("rendition", r.Name))
-		successRenditions = append(successRenditions, r)
+		logger.Info("rendition completed successfully", zap.String("rendition", job.Name))
+		if job.Audio != nil {
+			audioRenditions = append(audioRenditions, outputs[i])
+			continue
+		}
+		successRenditions = append(successRenditions, outputs[i])
 	}
 	
-	if len(failedRenditions) == len(renditions) {
+	if len(successRenditions) == 0 {
 		return types.UpdateVideoStatusEvent{}, fmt.Errorf("all renditions failed: %v", failedRenditions)
 	}
 	
 
+	progress.setStage(StageUpload)
 	masterPlaylistPath := filepath.Join(stagingDir, "master.m3u8")
-	if err := writeMasterPlaylist(masterPlaylistPath, successRenditions); err != nil {
+	if err := writeMasterPlaylist(masterPlaylistPath, successRenditions, audioRenditions, profile.AudioOnlyVariant, keyURL); err != nil {
 		return types.UpdateVideoStatusEvent{}, fmt.Errorf("write master playlist: %w", err)
 	}
 
+	// DASH players expect CENC, so AES-128 encrypted videos are HLS only
+	dashManifestPath := filepath.Join(stagingDir, "manifest.mpd")
+	if !opts.Encryption.enabled() {
+		if err := writeDashManifest(dashManifestPath, successRenditions, audioRenditions, duration); err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("write DASH manifest: %w", err)
+		}
+	}
+
+	// captions may have finished first, in which case they go in straight away
+	hasSubtitles, err := attachReadySubtitles(ctx, s3Client, bucketName, transcodedPrefix, request.VideoId, masterPlaylistPath)
+	if err != nil {
+		return types.UpdateVideoStatusEvent{}, fmt.Errorf("attach subtitles: %w", err)
+	}
+
+	// check the uploaded playlists and segments before the manifests make them public
+	master, err := os.ReadFile(masterPlaylistPath)
+	if err != nil {
+		return types.UpdateVideoStatusEvent{}, fmt.Errorf("read master playlist: %w", err)
+	}
+	var brokenSubtitles bool
+	if err := verifyPackage(ctx, s3Client, bucketName, transcodedPrefix, request.VideoId, master, logger); err != nil {
+		var broken *PackageError
+		if !errors.As(err, &broken) {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("verify HLS package: %w", err)
+		}
+		// the subtitles come from the captions service and re-encoding can't
+		// repair them, so the video is published without them
+		if problems, ok := broken.Problems[captionsTrack.Dir]; ok {
+			logger.Warn("subtitle rendition is broken, publishing without it", zap.Strings("problems", problems))
+			delete(broken.Problems, captionsTrack.Dir)
+			brokenSubtitles = true
+			hasSubtitles = false
+			if err := writeMasterPlaylist(masterPlaylistPath, successRenditions, audioRenditions, profile.AudioOnlyVariant, keyURL); err != nil {
+				return types.UpdateVideoStatusEvent{}, fmt.Errorf("write master playlist: %w", err)
+			}
+		}
+		if len(broken.Problems) > 0 {
+			// make the redelivery re-encode whatever turned out broken
+			for dir := range broken.Problems {
+				checkpoints.forget(ctx, dir)
+			}
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("verify HLS package: %w", err)
+		}
+	}
+
 	masterS3Key := path.Join(transcodedPrefix, request.VideoId, "master.m3u8")
+	var dashS3Key string
+	if !opts.Encryption.enabled() {
+		dashS3Key = path.Join(transcodedPrefix, request.VideoId, "manifest.mpd")
+	}
 	cacheControl := "public, max-age=31536000"
 	
-	if err := uploadFile(ctx, uploader, bucketName, masterS3Key, masterPlaylistPath, cacheControl, logger); err != nil {
+	if err := uploadFile(ctx, uploader, bucketName, masterS3Key, masterPlaylistPath, masterCacheControl, logger); err != nil {
 		return types.UpdateVideoStatusEvent{}, fmt.Errorf("upload master playlist: %w", err)
 	}
 
-	if err := <-thumbnailErrChan; err != nil {
-		return types.UpdateVideoStatusEvent{}, fmt.Errorf("generate thumbnail: %w", err)
+	// Captions that landed while the master was being uploaded saw no master to
+	// rewrite, so check once more now that it exists.
+	if !hasSubtitles && !brokenSubtitles {
+		if err := writeMasterPlaylist(masterPlaylistPath, successRenditions, audioRenditions, profile.AudioOnlyVariant, keyURL); err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("write master playlist: %w", err)
+		}
+		attached, err := attachReadySubtitles(ctx, s3Client, bucketName, transcodedPrefix, request.VideoId, masterPlaylistPath)
+		if err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("attach subtitles: %w", err)
+		}
+		if attached {
+			if err := uploadFile(ctx, uploader, bucketName, masterS3Key, masterPlaylistPath, masterCacheControl, logger); err != nil {
+				return types.UpdateVideoStatusEvent{}, fmt.Errorf("upload master playlist: %w", err)
+			}
+		}
+	}
+
+	if dashS3Key != "" {
+		if err := uploadFile(ctx, uploader, bucketName, dashS3Key, dashManifestPath, cacheControl, logger); err != nil {
+			return types.UpdateVideoStatusEvent{}, fmt.Errorf("upload DASH manifest: %w", err)
+		}
+	}
+
+	posters := <-posterChan
+	if posters.err != nil {
+		return types.UpdateVideoStatusEvent{}, fmt.Errorf("generate posters: %w", posters.err)
 	}
+	storyboardKey := <-storyboardKeyChan
+	preview := <-previewChan
+
+	progress.setPercent(100)
 
 	videoStatusEvent := types.UpdateVideoStatusEvent{
 		VideoId: request.VideoId,
 		Phase: "transcode",
 		ManifestKey: masterS3Key,
-		ThumbnailKey: thumbnailKey,
+		DashKey: dashS3Key,
+		ThumbnailKey: posters.posters[0].Images[0].Key, // largest JPEG of the best poster
+		Posters: posters.posters,
+		StoryboardKey: storyboardKey,
+		PreviewKey: preview.MP4,
+		PreviewWebPKey: preview.WebP,
 		VideoDuration: duration,
+		Metadata: &probe.Metadata,
+		Ladder: ladder,
+		Loudness: loudness,
+		Encrypted: opts.Encryption.enabled(),
 	}
 
 	return videoStatusEvent, nil
 }
 
-func processSingleRendition(
+// videoEncodeJob builds the encode for one rung of the video ladder.
+func videoEncodeJob(r renditionSpec, localVideoPath string, threads int, keyInfo string, mark *watermark) encodeJob {
+	return encodeJob{
+		Name:             r.Name,
+		Args:             argBuilder(r, localVideoPath, threads, keyInfo, mark),
+		Video:            &r,
+		NominalBandwidth: r.Bandwidth,
+	}
+}
+
+// audioEncodeJob builds the encode for one audio rendition.
+func audioEncodeJob(a audioSpec, localVideoPath string, threads int, keyInfo string) encodeJob {
+	bandwidth, _ := parseBitrate(a.Bitrate)
+	return encodeJob{
+		Name:             a.renditionName(),
+		Args:             audioArgBuilder(a, localVideoPath, threads, keyInfo),
+		Audio:            &a,
+		NominalBandwidth: bandwidth,
+	}
+}
+
+// runEncodeJob runs one ffmpeg encode, streams its segments to S3 as they are
+// written and uploads the media playlist and init segment once it finishes.
+func runEncodeJob(
 	ctx context.Context,
 	uploader *s3manager.Uploader,
-	bucket, localVideoPath, transcodedPrefix, videoID string,
-	r renditionSpec,
+	bucket, transcodedPrefix, videoID string,
+	job encodeJob,
 	stagingBase string,
+	duration float64,
+	progress *progressTracker,
 	logger *zap.Logger,
-) error {
-	log := logger.With(zap.String("rendition", r.Name))
+) (renditionOutput, error) {
+	log := logger.With(zap.String("rendition", job.Name))
 
-	renditionDir := filepath.Join(stagingBase, r.Name)
+	renditionDir := filepath.Join(stagingBase, job.Name)
 	if err := os.MkdirAll(renditionDir, 0755); err != nil {
-		return fmt.Errorf("create rendition directory: %w", err)
+		return renditionOutput{}, fmt.Errorf("create rendition directory: %w", err)
 	}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", argBuilder(r, localVideoPath)...)
+	args := append([]string{"-progress", "pipe:1", "-nostats"}, job.Args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	cmd.Dir=renditionDir
 
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
+	progressPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return renditionOutput{}, fmt.Errorf("ffmpeg (%s): %w", job.Name, err)
+	}
 
-	// Start uploader watcher BEFORE starting ffmpeg
-	var wg sync.WaitGroup
-	stop := make(chan struct{})
-	wg.Add(1)
-	go watchAndUploadSegments(
-		ctx, &wg, stop, uploader, bucket,
-		transcodedPrefix, videoID, r.Name, renditionDir, log,
-	)
+	// Start the segment uploader BEFORE starting ffmpeg
+	keyPrefix := path.Join(transcodedPrefix, videoID, job.Name)
+	segments, err := startSegmentUploader(ctx, uploader, bucket, keyPrefix, renditionDir, log)
+	if err != nil {
+		return renditionOutput{}, fmt.Errorf("segment uploader (%s): %w", job.Name, err)
+	}
 
 	if err := cmd.Start(); err != nil {
-		close(stop)
-		wg.Wait()
-		return fmt.Errorf("ffmpeg (%s): %w", r.Name, err)
+		segments.abort()
+		return renditionOutput{}, fmt.Errorf("ffmpeg (%s): %w", job.Name, err)
 	}
 
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		readFfmpegProgress(progressPipe, duration, func(percent float64) {
+			progress.setRendition(job.Name, percent)
+		})
+	}()
+	// the pipe must be drained before Wait closes it
+	<-progressDone
+
 	if err := cmd.Wait(); err != nil {
-		close(stop)
-		wg.Wait()
-		return fmt.Errorf("ffmpeg (%s) failed: %w\n%s", r.Name, err, stderrBuf.String())
+		segments.abort()
+		return renditionOutput{}, fmt.Errorf("ffmpeg (%s) failed: %w\n%s", job.Name, err, stderrBuf.String())
 	}
 
-	// Signal watcher to do a final sweep and exit
-	close(stop)
-	wg.Wait()
+	segmentSizes, err := segments.finish()
+	if err != nil {
+		return renditionOutput{}, fmt.Errorf("upload segments (%s): %w", job.Name, err)
+	}
 
 	indexPath := filepath.Join(renditionDir, "index.m3u8")
-	if _, err := os.Stat(indexPath); err == nil {
-		key := path.Join(transcodedPrefix, videoID, r.Name, "index.m3u8")
-		if err := uploadFile(ctx, uploader, bucket, key, indexPath, "public, max-age=31536000", log); err != nil {
-			log.Warn("final index.m3u8 upload failed", zap.Error(err))
+	playlist, err := parseMediaPlaylist(indexPath)
+	if err != nil {
+		return renditionOutput{}, fmt.Errorf("read media playlist (%s): %w", job.Name, err)
+	}
+	// never publish a playlist that points at a chunk that isn't in S3
+	for _, seg := range playlist.Segments {
+		if _, ok := segmentSizes[seg.URI]; !ok {
+			return renditionOutput{}, fmt.Errorf("segment %s of %s was never uploaded", seg.URI, job.Name)
 		}
 	}
 
+	output := renditionOutput{Name: job.Name, Audio: job.Audio, Playlist: playlist}
+	if job.Video != nil {
+		output.Spec = *job.Video
+		output.VideoRange = job.Video.videoRange()
+		output.FrameRate = job.Video.FrameRate
+		output.Width, output.Height = job.Video.Width, job.Video.Height
+	}
+
+	if peak, average, ok := measureBandwidth(playlist, segmentSizes); ok {
+		output.PeakBandwidth, output.AverageBandwidth = peak, average
+	} else {
+		log.Warn("segment sizes incomplete, using nominal bandwidth")
+		output.PeakBandwidth, output.AverageBandwidth = job.NominalBandwidth, job.NominalBandwidth
+	}
+
+	// the init segment carries the real coded size and codec configuration
 	initPath := filepath.Join(renditionDir, "init.mp4")
-	if _, err := os.Stat(initPath); err == nil {
-		key := path.Join(transcodedPrefix, videoID, r.Name, "init.mp4")
-		if err := uploadFile(ctx, uploader, bucket, key, initPath, "public, max-age=31536000, immutable", log); err != nil {
-			log.Warn("final init.mp4 upload failed", zap.Error(err))
+	if job.Video != nil {
+		if width, height, err := probeDimensions(ctx, initPath); err != nil {
+			log.Warn("could not read output resolution, using planned size", zap.Error(err))
+		} else {
+			output.Width, output.Height = width, height
 		}
 	}
 
-	log.Info("rendition complete")
-	return nil
-}
+	codecs, err := initSegmentCodecs(initPath)
+	if err != nil {
+		return renditionOutput{}, fmt.Errorf("read codecs (%s): %w", job.Name, err)
+	}
+	output.Codecs = codecs
 
+	if err := uploadWithRetry(ctx, uploader, bucket, path.Join(keyPrefix, "init.mp4"), initPath, "public, max-age=31536000, immutable", log); err != nil {
+		return renditionOutput{}, fmt.Errorf("upload init segment (%s): %w", job.Name, err)
+	}
+	// the playlist goes last, once everything it references is in place
+	if err := uploadWithRetry(ctx, uploader, bucket, path.Join(keyPrefix, "index.m3u8"), indexPath, "public, max-age=31536000", log); err != nil {
+		return renditionOutput{}, fmt.Errorf("upload media playlist (%s): %w", job.Name, err)
+	}
 
-func watchAndUploadSegments(
-	ctx context.Context,
-	wg *sync.WaitGroup,
-	stop <-chan struct{},
-	uploader *s3manager.Uploader,
-	bucket, transcodedPrefix, videoID, renditionName, dir string,
-	log *zap.Logger,
-) {
-	defer wg.Done()
+	log.Info("rendition complete", zap.Int("width", output.Width), zap.Int("height", output.Height))
+	return output, nil
+}
 
-	uploaded := make(map[string]struct{})
 
-	ticker := time.NewTicker(300 * time.Millisecond)
-	defer ticker.Stop()
+func argBuilder(r renditionSpec, inputVideoPath string, threads int, keyInfo string, mark *watermark) []string {
+    args := []string{
+        "-hide_banner", "-loglevel", "warning",
+        // Turn the source upright by its display matrix (ffmpeg's default,
+        // spelled out as the ladder is planned on the rotated size)
+        "-autorotate", "1",
+        "-i", inputVideoPath,
+    }
 
-	upload := func(name string) {
-		if !(strings.HasSuffix(name, ".m4s")) {
-			return
-		}
-		if _, ok := uploaded[name]; ok {
-			return
-		}
+    // Video only, audio lives in its own rendition
+    if mark == nil {
+        args = append(args, "-map", "0:v:0", "-vf", videoFilter(r))
+    } else {
+        // the watermark is drawn after scaling so it is sized for the rung
+        args = append(args, mark.inputArgs()...)
+        args = append(args, "-filter_complex", mark.filterGraph(videoFilter(r), r), "-map", "[v]")
+    }
+    args = append(args, "-an")
 
-		localPath := filepath.Join(dir, name)
-		
-		s3Key := path.Join(transcodedPrefix, videoID, renditionName, name)
+    args = append(args, videoCodecArgs(r)...)
+    args = append(args, colorArgs(r)...)
+    args = append(args,
+        "-maxrate", r.MaxBitrate,
+        "-bufsize", r.BufSize,
 
-		cacheControl := "public, max-age=31536000, immutable"
-		
-		if err := uploadFile(ctx, uploader, bucket, s3Key, localPath, cacheControl, log); err != nil {
-			log.Warn("upload failed", zap.Error(err))
-		} else {
-			uploaded[name] = struct{}{}
-		}
-	}
+        // Keyframe alignment for 4s segments
+        "-force_key_frames", keyframeExpr(r),
+    )
 
-	scan := func() {
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			log.Warn("scan dir failed", zap.Error(err))
-			return
-		}
-		for _, dirEntry := range entries {
-			if dirEntry.IsDir() { continue }
-			upload(dirEntry.Name())
-		}
-	}
+    return append(args, hlsOutputArgs(threads, keyInfo)...)
+}
 
-	for {
-		select {
-		case <-stop:
-			// final flush
-			for i := 0; i < 6; i++ { // ~1.8s of final settling
-				scan()
-				time.Sleep(300 * time.Millisecond)
-			}
-			return
-		case <-ticker.C:
-			scan()
-		}
+// videoCodecName names the codec of a rung, reporting H.264 explicitly.
+func videoCodecName(codec string) string {
+	if codec == "" {
+		return "h264"
 	}
+	return codec
 }
 
+// videoCodecArgs selects the encoder of a rung. Every encoder is kept from
+// placing keyframes on scene cuts so segments of all renditions line up.
+func videoCodecArgs(r renditionSpec) []string {
+    switch r.Codec {
+    case codecHEVC:
+        args := []string{
+            "-c:v", "libx265",
+            "-preset", "medium",
+            "-crf", strconv.Itoa(r.CRF),
+            // hvc1 keeps the parameter sets in the init segment, which Apple players require
+            "-tag:v", "hvc1",
+        }
+        params := "scenecut=0:open-gop=0:log-level=error"
+        if r.VideoRange != "" {
+            args = append(args, "-profile:v", "main10")
+            params += ":" + x265HDRParams(r.VideoRange)
+        }
+        return append(args, "-x265-params", params)
+    case codecAV1:
+        return []string{
+            "-c:v", "libsvtav1",
+            "-preset", "8",
+            "-crf", strconv.Itoa(r.CRF),
+            "-svtav1-params", fmt.Sprintf("keyint=%ds:scd=0", hlsSegmentSeconds),
+        }
+    default:
+        // H.264 tuned for streaming
+        return []string{
+            "-c:v", "libx264",
+            "-preset", "medium",
+            "-crf", strconv.Itoa(r.CRF),
+            "-sc_threshold", "0",
+        }
+    }
+}
 
-func argBuilder(r renditionSpec, inputVideoPath string) []string {
-    playlistPath := "index.m3u8"
-
-    return []string{
+func audioArgBuilder(a audioSpec, inputVideoPath string, threads int, keyInfo string) []string {
+    args := []string{
         "-hide_banner", "-loglevel", "warning",
         "-i", inputVideoPath,
 
-        // Map video + optional audio
-        "-map", "0:v:0",
-        "-map", "0:a:0?",
-
-        // Scaling
-        "-vf", "scale=" + r.Scale,
+        // One source audio stream per rendition
+        "-map", fmt.Sprintf("0:a:%d", a.StreamIndex),
+        "-vn",
+    }
 
-        // Video encoding (H.264) tuned for streaming
-        "-c:v", "libx264",
-        "-preset", "medium",
-        "-crf", r.CRF,
-        "-maxrate", r.MaxBitrate,
-        "-bufsize", r.BufSize,
-        "-pix_fmt", "yuv420p",
+    // Second loudnorm pass, with what the first one measured
+    if a.Loudnorm != nil {
+        args = append(args, "-af", a.Loudnorm.filter())
+    }
 
-        // Keyframe alignment for 4s segments
-        "-sc_threshold", "0",
-        "-force_key_frames", "expr:gte(t,n_forced*4)",
+    args = append(args,
 
-        // Audio encoding (AAC-LC stereo)
+        // Audio encoding (AAC-LC)
         "-c:a", "aac",
         "-profile:a", "aac_low",
-        "-b:a", "128k",
-        "-ac", "2",
-        "-ar", "48000",
+        "-b:a", a.Bitrate,
+        "-ac", strconv.Itoa(a.Channels),
+        "-ar", strconv.Itoa(audioSampleRate),
+    )
+
+    return append(args, hlsOutputArgs(threads, keyInfo)...)
+}
 
+// hlsOutputArgs is the CMAF HLS output shared by every rendition, written to
+// index.m3u8 in the encode's working directory. A key info file turns on
+// AES-128 encryption of the segments.
+func hlsOutputArgs(threads int, keyInfo string) []string {
+    args := []string{
         // --- HLS (CMAF/fMP4) output ---
         "-f", "hls",
         "-hls_playlist_type", "vod",              // Finalized playlist with #EXT-X-ENDLIST
-        "-hls_time", "4",                         // 4s segments
+        "-hls_time", strconv.Itoa(hlsSegmentSeconds), // 4s segments
         "-hls_flags", "independent_segments+temp_file",     // IDR frame at segment start
         "-hls_segment_type", "fmp4",              // Fragmented MP4 (CMAF)
         "-hls_fmp4_init_filename", "init.mp4",    // Will be in same folder as playlist
         "-hls_segment_filename", "chunk_%05d.m4s",// Relative paths in playlist
         "-hls_list_size", "0",                    // Keep all segments in VOD
-        playlistPath,                             // Output media playlist
+        // Start the media timeline at 0 whatever the source's start PTS, as the
+        // subtitles' X-TIMESTAMP-MAP maps caption time 0 to media time 0
+        "-avoid_negative_ts", "make_zero",
+    }
+
+    if keyInfo != "" {
+        args = append(args, "-hls_key_info_file", keyInfo)
     }
+
+    // Cap per-encode threads so parallel encodes share the CPU budget
+    if threads > 0 {
+        args = append(args, "-threads", strconv.Itoa(threads))
+    }
+
+    return append(args, "index.m3u8") // Output media playlist
 }
 
 func contentTypeFor(p string) string {
@@ -396,90 +816,86 @@ func uploadFile(
 		return fmt.Errorf("upload %s: %w", key, err)
 	}
 
-	_ = os.Remove(localPath)
 	log.Info("uploaded", zap.String("key", key))
 	return nil
 }
 
-func writeMasterPlaylist(dst string, items []renditionSpec) error {
+// audioGroupID names the EXT-X-MEDIA group holding the audio rendition.
+const audioGroupID = "audio"
+
+func writeMasterPlaylist(dst string, items []renditionOutput, audio []renditionOutput, audioOnlyVariant bool, keyURL string) error {
 	var b strings.Builder
 	b.WriteString("#EXTM3U\n")
 	b.WriteString("#EXT-X-VERSION:7\n")
 	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
-	for _, it := range items {
-		// RESOLUTION from Scale (e.g., 1280x720)
-		res := it.Scale
-		// AVERAGE-BANDWIDTH ~ 85% of peak as a heuristic
-		avg := int(float64(it.Bandwidth) * 0.85)
-		// CODECS are reasonably generic for H.264 + AAC LC
-		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%s,CODECS=\"avc1.42E01E,mp4a.40.2\"\n", it.Bandwidth, avg, res)
-		fmt.Fprintf(&b, "%s/index.m3u8\n", it.Name)
+	// lets players fetch the key before the first media playlist
+	if keyURL != "" {
+		fmt.Fprintf(&b, "#EXT-X-SESSION-KEY:METHOD=AES-128,URI=\"%s\"\n", keyURL)
 	}
-	return os.WriteFile(dst, []byte(b.String()), 0644)
-}
-
-func generateThumbnail(ctx context.Context, uploader *s3manager.Uploader, bucket, stagingDir, s3Key, videoPath string, duration float64, logger *zap.Logger) error {
-    thumbDir := filepath.Join(stagingDir, "thumbnails")
-    if err := os.MkdirAll(thumbDir, 0755); err != nil {
-        return err
-    }
 
-	seekTime := duration * 0.25
-	seekTimeStr := fmt.Sprintf("%.1f", seekTime) // the .1f here means 1 decimal place
+	// Audio is shared by every variant, so each variant's BANDWIDTH has to
+	// include the largest audio rendition it may be paired with.
+	var audioPeak, audioAverage int
+	var audioCodecs string
+	defaultAudio := -1
+	for i, a := range audio {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",", audioGroupID, quotedAttribute(a.Audio.Label))
+		if a.Audio.Language != "" {
+			fmt.Fprintf(&b, "LANGUAGE=\"%s\",", a.Audio.Language)
+		}
+		// commentary and descriptions must be picked by hand, never by the player
+		autoselect := !a.Audio.Commentary && !a.Audio.VisualImpaired
+		fmt.Fprintf(&b, "DEFAULT=%s,AUTOSELECT=%s,", yesNo(a.Audio.Default), yesNo(autoselect || a.Audio.Default))
+		if a.Audio.VisualImpaired {
+			b.WriteString("CHARACTERISTICS=\"public.accessibility.describes-video\",")
+		}
+		fmt.Fprintf(&b, "CHANNELS=\"%d\",URI=\"%s/index.m3u8\"\n", a.Audio.Channels, a.Name)
 
-    poster := filepath.Join(thumbDir, "poster.jpg")
-    cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-ss", seekTimeStr, "-i", videoPath,
-        "-frames:v", "1",
-        "-vf", "scale=1280:-1:force_original_aspect_ratio=decrease",
-        "-q:v", "2", poster)
-    cmd.Stderr = os.Stderr
+		audioPeak = max(audioPeak, a.PeakBandwidth)
+		audioAverage = max(audioAverage, a.AverageBandwidth)
+		audioCodecs = a.Codecs
+		if a.Audio.Default {
+			defaultAudio = i
+		}
+	}
 
-    if err := cmd.Run(); err != nil {
-        logger.Warn("poster generation failed", zap.Error(err))
-        return err
-    }
+	for _, it := range items {
+		codecs := it.Codecs
+		if audioCodecs != "" {
+			codecs += "," + audioCodecs
+		}
+		// RESOLUTION as read back from the produced init segment (e.g., 1280x720 or 720x1280)
+		res := fmt.Sprintf("%dx%d", it.Width, it.Height)
+		// BANDWIDTH/AVERAGE-BANDWIDTH are measured from segment sizes, CODECS from the init segment
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%s,", it.PeakBandwidth+audioPeak, it.AverageBandwidth+audioAverage, res)
+		if it.FrameRate.Num > 0 {
+			fmt.Fprintf(&b, "FRAME-RATE=%.3f,", it.FrameRate.float())
+		}
+		fmt.Fprintf(&b, "CODECS=\"%s\",VIDEO-RANGE=%s", codecs, it.VideoRange)
+		if len(audio) > 0 {
+			fmt.Fprintf(&b, ",AUDIO=\"%s\"", audioGroupID)
+		}
+		fmt.Fprintf(&b, "\n%s/index.m3u8\n", it.Name)
+	}
 
-    
-    if err := uploadFile(ctx, uploader, bucket, s3Key, poster, "public, max-age=31536000, immutable", logger); err != nil {
-        logger.Warn("poster upload failed", zap.Error(err))
-        return err
-    }
+	// Audio-only variant as a last resort for very poor connections and podcast-style playback
+	if audioOnlyVariant && defaultAudio >= 0 {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=\"%s\",AUDIO=\"%s\"\n", audioPeak, audioAverage, audioCodecs, audioGroupID)
+		fmt.Fprintf(&b, "%s/index.m3u8\n", audio[defaultAudio].Name)
+	}
 
-    return nil
+	return os.WriteFile(dst, []byte(b.String()), 0644)
 }
 
-func getVideoDuration(ctx context.Context, videoPath string) (float64, error) {
-    // ffprobe command to output JSON with just the duration
-    cmd := exec.CommandContext(ctx, "ffprobe",
-        "-v", "quiet",
-        "-print_format", "json",
-        "-show_format",
-        videoPath,
-    )
-
-    var out bytes.Buffer
-    cmd.Stdout = &out
-	cmd.Stderr = io.Discard
-
-    if err := cmd.Run(); err != nil {
-        return 0, err
-    }
-
-    // Parse JSON
-    var probe struct {
-        Format struct {
-            Duration string `json:"duration"`
-        } `json:"format"`
-    }
-
-    if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
-        return 0, err
-    }
-
-    dur, err := strconv.ParseFloat(probe.Format.Duration, 64)
-    if err != nil {
-        return 0, err
-    }
+// quotedAttribute makes s safe inside a quoted HLS attribute value, which
+// can't contain double quotes or line breaks.
+func quotedAttribute(s string) string {
+	return strings.NewReplacer("\"", "'", "\n", " ", "\r", " ").Replace(s)
+}
 
-    return dur, nil
-}
\ No newline at end of file
+func yesNo(v bool) string {
+	if v {
+		return "YES"
+	}
+	return "NO"
+}
@@ -0,0 +1,357 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownProfile is returned when a request asks for an encoding profile
+// that is not defined in the loaded profile file.
+var ErrUnknownProfile = errors.New("unknown encoding profile")
+
+// defaultAudioBitrate is used when a profile doesn't set audioBitrate.
+const defaultAudioBitrate = "128k"
+
+// defaultProfileName is used when neither the config nor the profile file
+// names a default profile.
+const defaultProfileName = "default"
+
+// Video codecs a profile can add next to its H.264 ladder.
+const (
+	codecHEVC = "hevc"
+	codecAV1  = "av1"
+)
+
+// codecDefaults holds the settings of each additional codec when a profile
+// doesn't override them. HEVC and AV1 reach H.264's quality at a fraction of
+// its bitrate; SVT-AV1's crf scale runs to 63, hence the offset.
+var codecDefaults = map[string]codecVariant{
+	codecHEVC: {Codec: codecHEVC, BitrateFactor: 0.7, CRFOffset: intPtr(0)},
+	codecAV1:  {Codec: codecAV1, BitrateFactor: 0.5, CRFOffset: intPtr(8)},
+}
+
+// maxCRF is the top of each encoder's crf scale.
+var maxCRF = map[string]int{"": 51, codecHEVC: 51, codecAV1: 63}
+
+// codecVariant adds a copy of a profile's ladder encoded with another codec.
+type codecVariant struct {
+	Codec string `yaml:"codec" json:"codec"`
+	// BitrateFactor scales maxBitrate, bufSize and bandwidth of every rung
+	BitrateFactor float64 `yaml:"bitrateFactor" json:"bitrateFactor"`
+	// CRFOffset is added to the crf of every rung
+	CRFOffset *int `yaml:"crfOffset" json:"crfOffset"`
+}
+
+// renditionNamePattern keeps rendition names safe to use as directory names
+// and S3 key segments.
+var renditionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// encodingProfile is a named encoding ladder, e.g. one for long-form uploads
+// and a lighter one for shorts.
+type encodingProfile struct {
+	Renditions []renditionSpec `yaml:"renditions" json:"renditions"`
+	// AudioBitrate is the AAC bitrate of the standalone audio rendition
+	AudioBitrate string `yaml:"audioBitrate" json:"audioBitrate"`
+	// AudioOnlyVariant adds an audio-only entry to the master playlist
+	AudioOnlyVariant bool `yaml:"audioOnlyVariant" json:"audioOnlyVariant"`
+	// AdditionalCodecs encodes the ladder again in HEVC and/or AV1 for the
+	// players that can decode them; H.264 is always produced
+	AdditionalCodecs []codecVariant `yaml:"additionalCodecs" json:"additionalCodecs"`
+	// ContentAware fits the ladder's bitrates, crf and rung count to each
+	// video after a quick complexity analysis
+	ContentAware bool `yaml:"contentAware" json:"contentAware"`
+	// HDR adds a 10-bit HEVC copy of the ladder for HDR sources that keeps
+	// their dynamic range; the other rungs are always tone mapped to SDR
+	HDR bool `yaml:"hdr" json:"hdr"`
+}
+
+// codecRenditions derives the rungs of the profile's additional codecs from
+// the planned H.264 rungs. They are named after their H.264 rung, e.g. 720p_hevc.
+func (p encodingProfile) codecRenditions(planned []renditionSpec) []renditionSpec {
+	var derived []renditionSpec
+	for _, variant := range p.AdditionalCodecs {
+		for _, r := range planned {
+			r = variant.apply(r)
+			r.Name = r.Name + "_" + variant.Codec
+			derived = append(derived, r)
+		}
+	}
+	return derived
+}
+
+// apply re-targets a rung at the variant's codec, scaling its rates and
+// offsetting its crf. The crf is kept on the codec's scale, as a rung the
+// content-aware ladder moved can end up past its end once offset.
+func (v codecVariant) apply(r renditionSpec) renditionSpec {
+	r.Codec = v.Codec
+	r.CRF = max(0, min(maxCRF[v.Codec], r.CRF+*v.CRFOffset))
+	r.MaxBitrate = scaleBitrate(r.MaxBitrate, v.BitrateFactor)
+	r.BufSize = scaleBitrate(r.BufSize, v.BitrateFactor)
+	r.Bandwidth = int(float64(r.Bandwidth) * v.BitrateFactor)
+	return r
+}
+
+// audio returns the audio rendition settings of the profile.
+func (p encodingProfile) audio() audioSpec {
+	return audioSpec{Bitrate: p.AudioBitrate, Channels: 2}
+}
+
+// profileFile mirrors the on-disk layout of the profiles file.
+type profileFile struct {
+	Default  string                     `yaml:"default" json:"default"`
+	Profiles map[string]encodingProfile `yaml:"profiles" json:"profiles"`
+}
+
+// Profiles holds every validated encoding profile available to the processor.
+type Profiles struct {
+	defaultName string
+	profiles    map[string]encodingProfile
+}
+
+// builtinProfiles is the ladder used when no profile file is configured.
+func builtinProfiles() *Profiles {
+	return &Profiles{
+		defaultName: defaultProfileName,
+		profiles: map[string]encodingProfile{
+			defaultProfileName: {Renditions: []renditionSpec{
+				{Name: "1080p", Width: 1920, Height: 1080, CRF: 32, MaxBitrate: "5000k", BufSize: "10000k", Bandwidth: 5000000},
+				{Name: "720p", Width: 1280, Height: 720, CRF: 34, MaxBitrate: "3000k", BufSize: "6000k", Bandwidth: 3000000},
+				{Name: "480p", Width: 854, Height: 480, CRF: 36, MaxBitrate: "1200k", BufSize: "2400k", Bandwidth: 1200000},
+			}, AudioBitrate: defaultAudioBitrate},
+		},
+	}
+}
+
+// LoadProfiles reads and validates the encoding profiles file at path. YAML and
+// JSON files are both accepted, picked by extension. An empty path yields the
+// built-in ladder. defaultName overrides the default declared in the file.
+func LoadProfiles(path, defaultName string) (*Profiles, error) {
+	if path == "" {
+		profiles := builtinProfiles()
+		if defaultName != "" && defaultName != profiles.defaultName {
+			return nil, fmt.Errorf("default profile %q: %w", defaultName, ErrUnknownProfile)
+		}
+		return profiles, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profiles file: %w", err)
+	}
+
+	var file profileFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&file)
+	default:
+		return nil, fmt.Errorf("profiles file %s: unsupported extension, want .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse profiles file: %w", err)
+	}
+
+	if len(file.Profiles) == 0 {
+		return nil, fmt.Errorf("profiles file %s defines no profiles", path)
+	}
+
+	for name, profile := range file.Profiles {
+		normalized, err := validateProfile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		file.Profiles[name] = normalized
+	}
+
+	if defaultName == "" {
+		defaultName = file.Default
+	}
+	if defaultName == "" {
+		defaultName = defaultProfileName
+	}
+	if _, ok := file.Profiles[defaultName]; !ok {
+		return nil, fmt.Errorf("default profile %q: %w", defaultName, ErrUnknownProfile)
+	}
+
+	return &Profiles{defaultName: defaultName, profiles: file.Profiles}, nil
+}
+
+// resolve returns the name of the profile a request asking for name gets.
+func (p *Profiles) resolve(name string) string {
+	if name == "" {
+		return p.defaultName
+	}
+	return name
+}
+
+// lookup returns the named profile, or the default one when name is empty.
+func (p *Profiles) lookup(name string) (encodingProfile, error) {
+	name = p.resolve(name)
+	profile, ok := p.profiles[name]
+	if !ok {
+		return encodingProfile{}, fmt.Errorf("%w: %q", ErrUnknownProfile, name)
+	}
+	return profile, nil
+}
+
+// validateProfile checks every rendition and fills in derived fields.
+func validateProfile(profile encodingProfile) (encodingProfile, error) {
+	if len(profile.Renditions) == 0 {
+		return profile, fmt.Errorf("no renditions")
+	}
+
+	if profile.AudioBitrate == "" {
+		profile.AudioBitrate = defaultAudioBitrate
+	}
+	if _, err := parseBitrate(profile.AudioBitrate); err != nil {
+		return profile, fmt.Errorf("audioBitrate: %w", err)
+	}
+
+	variants, err := validateCodecVariants(profile.AdditionalCodecs)
+	if err != nil {
+		return profile, err
+	}
+	profile.AdditionalCodecs = variants
+
+	seen := make(map[string]struct{}, len(profile.Renditions))
+	renditions := make([]renditionSpec, 0, len(profile.Renditions))
+	for i, r := range profile.Renditions {
+		if !renditionNamePattern.MatchString(r.Name) {
+			return profile, fmt.Errorf("rendition %d: invalid name %q", i, r.Name)
+		}
+		if strings.HasPrefix(r.Name, "audio") {
+			return profile, fmt.Errorf("rendition %d: names starting with \"audio\" are reserved for audio renditions, got %q", i, r.Name)
+		}
+		if _, dup := seen[r.Name]; dup {
+			return profile, fmt.Errorf("rendition %q: duplicate name", r.Name)
+		}
+		seen[r.Name] = struct{}{}
+
+		if r.Width <= 0 || r.Height <= 0 || r.Width%2 != 0 || r.Height%2 != 0 {
+			return profile, fmt.Errorf("rendition %q: width and height must be positive even numbers, got %dx%d", r.Name, r.Width, r.Height)
+		}
+		if r.CRF < 0 || r.CRF > 51 {
+			return profile, fmt.Errorf("rendition %q: crf %d out of range 0-51", r.Name, r.CRF)
+		}
+		for _, variant := range variants {
+			if crf := r.CRF + *variant.CRFOffset; crf < 0 || crf > maxCRF[variant.Codec] {
+				return profile, fmt.Errorf("rendition %q: %s crf %d out of range 0-%d", r.Name, variant.Codec, crf, maxCRF[variant.Codec])
+			}
+		}
+
+		maxBitrate, err := parseBitrate(r.MaxBitrate)
+		if err != nil {
+			return profile, fmt.Errorf("rendition %q: maxBitrate: %w", r.Name, err)
+		}
+		if _, err := parseBitrate(r.BufSize); err != nil {
+			return profile, fmt.Errorf("rendition %q: bufSize: %w", r.Name, err)
+		}
+		if r.MaxFrameRate < 0 {
+			return profile, fmt.Errorf("rendition %q: negative maxFrameRate", r.Name)
+		}
+		if r.Bandwidth < 0 {
+			return profile, fmt.Errorf("rendition %q: negative bandwidth", r.Name)
+		}
+		if r.Bandwidth == 0 {
+			r.Bandwidth = maxBitrate
+		}
+
+		renditions = append(renditions, r)
+	}
+
+	// the derived rungs share the directory namespace with the configured ones
+	for _, variant := range variants {
+		for _, r := range renditions {
+			if _, dup := seen[r.Name+"_"+variant.Codec]; dup {
+				return profile, fmt.Errorf("rendition %q clashes with the %s copy of %q", r.Name+"_"+variant.Codec, variant.Codec, r.Name)
+			}
+		}
+	}
+	if profile.HDR {
+		for _, r := range renditions {
+			if _, dup := seen[r.Name+hdrSuffix]; dup {
+				return profile, fmt.Errorf("rendition %q clashes with the HDR copy of %q", r.Name+hdrSuffix, r.Name)
+			}
+		}
+	}
+
+	profile.Renditions = renditions
+	return profile, nil
+}
+
+// validateCodecVariants checks the additional codecs of a profile and fills
+// in the defaults of the settings they leave out.
+func validateCodecVariants(variants []codecVariant) ([]codecVariant, error) {
+	seen := make(map[string]struct{}, len(variants))
+	normalized := make([]codecVariant, 0, len(variants))
+	for _, v := range variants {
+		defaults, ok := codecDefaults[v.Codec]
+		if !ok {
+			return nil, fmt.Errorf("additionalCodecs: unsupported codec %q, want %s or %s", v.Codec, codecHEVC, codecAV1)
+		}
+		if _, dup := seen[v.Codec]; dup {
+			return nil, fmt.Errorf("additionalCodecs: duplicate codec %q", v.Codec)
+		}
+		seen[v.Codec] = struct{}{}
+
+		if v.BitrateFactor < 0 {
+			return nil, fmt.Errorf("additionalCodecs: %s bitrateFactor must be positive", v.Codec)
+		}
+		if v.BitrateFactor == 0 {
+			v.BitrateFactor = defaults.BitrateFactor
+		}
+		if v.CRFOffset == nil {
+			v.CRFOffset = defaults.CRFOffset
+		}
+		normalized = append(normalized, v)
+	}
+	return normalized, nil
+}
+
+// scaleBitrate scales an ffmpeg style rate, returning it in kbit/s.
+// The rate has been validated by parseBitrate already.
+func scaleBitrate(rate string, factor float64) string {
+	bps, _ := parseBitrate(rate)
+	return fmt.Sprintf("%dk", max(1, int(float64(bps)*factor/1000)))
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+// parseBitrate parses ffmpeg style rates such as "5000k", "5M" or "800000"
+// into bits per second.
+func parseBitrate(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty bitrate")
+	}
+
+	number, multiplier := s, 1
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		number, multiplier = s[:len(s)-1], 1000
+	case 'm', 'M':
+		number, multiplier = s[:len(s)-1], 1000*1000
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+	return int(value * float64(multiplier)), nil
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func validRendition(name string) renditionSpec {
+	return renditionSpec{Name: name, Width: 1280, Height: 720, CRF: 30, MaxBitrate: "3000k", BufSize: "6000k"}
+}
+
+func TestValidateProfileDefaults(t *testing.T) {
+	profile, err := validateProfile(encodingProfile{
+		Renditions:       []renditionSpec{validRendition("720p")},
+		AdditionalCodecs: []codecVariant{{Codec: codecAV1}},
+	})
+	if err != nil {
+		t.Fatalf("validateProfile: %v", err)
+	}
+
+	if profile.AudioBitrate != defaultAudioBitrate {
+		t.Errorf("audioBitrate = %q, want %q", profile.AudioBitrate, defaultAudioBitrate)
+	}
+	if got := profile.Renditions[0].Bandwidth; got != 3000000 {
+		t.Errorf("bandwidth = %d, want maxBitrate 3000000", got)
+	}
+	av1 := profile.AdditionalCodecs[0]
+	if av1.BitrateFactor != 0.5 || av1.CRFOffset == nil || *av1.CRFOffset != 8 {
+		t.Errorf("av1 variant = factor %v offset %v, want the codec defaults", av1.BitrateFactor, av1.CRFOffset)
+	}
+}
+
+func TestValidateProfileErrors(t *testing.T) {
+	with := func(mutate func(*renditionSpec)) []renditionSpec {
+		r := validRendition("720p")
+		mutate(&r)
+		return []renditionSpec{r}
+	}
+
+	tests := []struct {
+		name    string
+		profile encodingProfile
+		want    string
+	}{
+		{"no renditions", encodingProfile{}, "no renditions"},
+		{"bad audio bitrate", encodingProfile{Renditions: with(func(*renditionSpec) {}), AudioBitrate: "loud"}, "audioBitrate"},
+		{"invalid name", encodingProfile{Renditions: with(func(r *renditionSpec) { r.Name = "../720p" })}, "invalid name"},
+		{"reserved name", encodingProfile{Renditions: with(func(r *renditionSpec) { r.Name = "audio_main" })}, "reserved"},
+		{"duplicate name", encodingProfile{Renditions: []renditionSpec{validRendition("720p"), validRendition("720p")}}, "duplicate name"},
+		{"odd width", encodingProfile{Renditions: with(func(r *renditionSpec) { r.Width = 1279 })}, "positive even"},
+		{"zero height", encodingProfile{Renditions: with(func(r *renditionSpec) { r.Height = 0 })}, "positive even"},
+		{"crf too high", encodingProfile{Renditions: with(func(r *renditionSpec) { r.CRF = 52 })}, "crf 52"},
+		{"negative crf", encodingProfile{Renditions: with(func(r *renditionSpec) { r.CRF = -1 })}, "crf -1"},
+		{
+			"variant crf past the codec's scale",
+			encodingProfile{Renditions: with(func(r *renditionSpec) { r.CRF = 51 }), AdditionalCodecs: []codecVariant{{Codec: codecAV1, CRFOffset: intPtr(13)}}},
+			"av1 crf 64 out of range 0-63",
+		},
+		{"bad max bitrate", encodingProfile{Renditions: with(func(r *renditionSpec) { r.MaxBitrate = "fast" })}, "maxBitrate"},
+		{"bad buf size", encodingProfile{Renditions: with(func(r *renditionSpec) { r.BufSize = "" })}, "bufSize"},
+		{"negative max frame rate", encodingProfile{Renditions: with(func(r *renditionSpec) { r.MaxFrameRate = -30 })}, "maxFrameRate"},
+		{"negative bandwidth", encodingProfile{Renditions: with(func(r *renditionSpec) { r.Bandwidth = -1 })}, "bandwidth"},
+		{
+			"unsupported codec",
+			encodingProfile{Renditions: with(func(*renditionSpec) {}), AdditionalCodecs: []codecVariant{{Codec: "vp9"}}},
+			"unsupported codec",
+		},
+		{
+			"duplicate codec",
+			encodingProfile{Renditions: with(func(*renditionSpec) {}), AdditionalCodecs: []codecVariant{{Codec: codecHEVC}, {Codec: codecHEVC}}},
+			"duplicate codec",
+		},
+		{
+			"codec copy clashes",
+			encodingProfile{Renditions: []renditionSpec{validRendition("720p"), validRendition("720p_hevc")}, AdditionalCodecs: []codecVariant{{Codec: codecHEVC}}},
+			"clashes with the hevc copy",
+		},
+		{
+			"hdr copy clashes",
+			encodingProfile{Renditions: []renditionSpec{validRendition("720p"), validRendition("720p_hdr")}, HDR: true},
+			"clashes with the HDR copy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateProfile(tt.profile)
+			if err == nil {
+				t.Fatalf("validateProfile succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodecVariantApply(t *testing.T) {
+	r := renditionSpec{Name: "720p", CRF: 60, MaxBitrate: "3000k", BufSize: "6000k", Bandwidth: 3000000}
+
+	got := codecVariant{Codec: codecHEVC, BitrateFactor: 0.5, CRFOffset: intPtr(4)}.apply(r)
+	if got.Codec != codecHEVC || got.MaxBitrate != "1500k" || got.BufSize != "3000k" || got.Bandwidth != 1500000 {
+		t.Errorf("apply = %+v, want hevc at half the rates", got)
+	}
+	if got.CRF != 51 {
+		t.Errorf("hevc crf = %d, want it clamped to 51", got.CRF)
+	}
+
+	got = codecVariant{Codec: codecAV1, BitrateFactor: 0.5, CRFOffset: intPtr(8)}.apply(r)
+	if got.CRF != 63 {
+		t.Errorf("av1 crf = %d, want it clamped to 63", got.CRF)
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"5000k", 5000000, false},
+		{"5M", 5000000, false},
+		{"1.5m", 1500000, false},
+		{" 800000 ", 800000, false},
+		{"", 0, true},
+		{"k", 0, true},
+		{"0k", 0, true},
+		{"-5M", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBitrate(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBitrate(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
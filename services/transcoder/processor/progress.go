@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+)
+
+// Stages reported in progress events, in the order a transcode goes through them.
+const (
+	StageDownload = "download"
+	StageProbe    = "probe"
+	StageEncode   = "encode"
+	StageUpload   = "upload"
+)
+
+// progressInterval throttles progress events to one per interval per video.
+const progressInterval = time.Second
+
+// ProgressFunc receives the progress of a transcode. Calls are serialised and
+// made from a goroutine of their own, so a slow ProgressFunc only makes
+// updates get skipped, never holds up the encodes.
+type ProgressFunc func(types.TranscodeProgressEvent)
+
+// progressTracker aggregates the progress of one video and hands throttled
+// snapshots to a ProgressFunc. A tracker with a nil ProgressFunc does nothing.
+type progressTracker struct {
+	mu           sync.Mutex
+	videoID      string
+	report       ProgressFunc
+	stage        string
+	stageStarted time.Time
+	percent      float64            // of stages without renditions
+	renditions   map[string]float64 // percent per rendition while encoding
+	lastSent     time.Time
+	// pending holds the latest snapshot not yet reported; a newer one
+	// replaces it, as only the latest progress matters
+	pending chan types.TranscodeProgressEvent
+	done    chan struct{}
+	closed  bool
+}
+
+func newProgressTracker(videoID string, report ProgressFunc) *progressTracker {
+	t := &progressTracker{videoID: videoID, report: report}
+	if report != nil {
+		t.pending = make(chan types.TranscodeProgressEvent, 1)
+		t.done = make(chan struct{})
+		go t.deliver()
+	}
+	return t
+}
+
+// deliver reports the snapshots until close.
+func (t *progressTracker) deliver() {
+	defer close(t.done)
+	for event := range t.pending {
+		t.report(event)
+	}
+}
+
+// close reports the last pending snapshot and stops the tracker. It must be
+// called once nothing updates the tracker any more.
+func (t *progressTracker) close() {
+	if t.report == nil {
+		return
+	}
+	t.mu.Lock()
+	t.closed = true
+	close(t.pending)
+	t.mu.Unlock()
+	<-t.done
+}
+
+// setStage moves to the next stage and reports it straight away.
+func (t *progressTracker) setStage(stage string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stage = stage
+	t.stageStarted = time.Now()
+	t.percent = 0
+	t.renditions = nil
+	t.emitLocked(true)
+}
+
+// setPercent updates the progress of a stage without renditions.
+func (t *progressTracker) setPercent(percent float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.percent = percent
+	t.emitLocked(percent >= 100)
+}
+
+// setRendition updates the encode progress of one rendition. Renditions are
+// registered by their first update, so every job should report 0 when it starts.
+func (t *progressTracker) setRendition(name string, percent float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.renditions == nil {
+		t.renditions = make(map[string]float64)
+	}
+	t.renditions[name] = percent
+	t.emitLocked(percent >= 100)
+}
+
+func (t *progressTracker) emitLocked(force bool) {
+	if t.report == nil || t.closed {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(t.lastSent) < progressInterval {
+		return
+	}
+	t.lastSent = now
+
+	percent := t.percent
+	var renditions map[string]float64
+	if len(t.renditions) > 0 {
+		percent = 0
+		renditions = make(map[string]float64, len(t.renditions))
+		for name, p := range t.renditions {
+			renditions[name] = math.Round(p*10) / 10
+			percent += p
+		}
+		percent /= float64(len(t.renditions))
+	}
+
+	event := types.TranscodeProgressEvent{
+		VideoId:    t.videoID,
+		Stage:      t.stage,
+		Percent:    math.Round(percent*10) / 10,
+		Renditions: renditions,
+	}
+	// a linear extrapolation is good enough for a progress bar
+	if percent > 0 && percent < 100 {
+		elapsed := now.Sub(t.stageStarted).Seconds()
+		event.ETASeconds = math.Round(elapsed * (100 - percent) / percent)
+	}
+	// drop the stale snapshot if deliver hasn't picked it up yet
+	select {
+	case <-t.pending:
+	default:
+	}
+	t.pending <- event
+}
+
+// readFfmpegProgress parses the key=value stream ffmpeg writes for
+// -progress and calls onPercent with how far into duration it has got.
+func readFfmpegProgress(r io.Reader, duration float64, onPercent func(float64)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		// out_time_ms is in microseconds as well, but older builds only print it
+		case "out_time_us", "out_time_ms":
+			us, err := strconv.ParseFloat(value, 64)
+			if err != nil || duration <= 0 {
+				continue
+			}
+			onPercent(math.Min(99.9, math.Max(0, us/1e6/duration*100)))
+		case "progress":
+			if value == "end" {
+				onPercent(100)
+			}
+		}
+	}
+	// keep ffmpeg from blocking on a full pipe if scanning gave up early
+	io.Copy(io.Discard, r)
+}
+
+// progressWriterAt counts the bytes the S3 downloader writes.
+type progressWriterAt struct {
+	w          io.WriterAt
+	total      int64
+	mu         sync.Mutex
+	written    int64
+	onProgress func(float64)
+}
+
+func (p *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(b, off)
+
+	p.mu.Lock()
+	p.written += int64(n)
+	written := p.written
+	p.mu.Unlock()
+
+	if p.total > 0 {
+		p.onProgress(math.Min(100, float64(written)/float64(p.total)*100))
+	}
+	return n, err
+}
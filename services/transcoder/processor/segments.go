@@ -0,0 +1,212 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	// segmentUploadWorkers uploads run at once per rendition.
+	segmentUploadWorkers = 4
+	// uploadAttempts is how often an upload is tried before the rendition fails.
+	uploadAttempts = 5
+	// uploadBackoff is the wait before the first retry; it doubles every attempt.
+	uploadBackoff = 500 * time.Millisecond
+)
+
+// segmentUploader uploads the media segments of one rendition as ffmpeg
+// finishes them. ffmpeg writes each segment to a .tmp file and renames it
+// (hls_flags temp_file), so a segment is complete once its final name
+// appears. Segments are removed locally after upload to keep the staging
+// disk bounded on long videos.
+type segmentUploader struct {
+	ctx       context.Context
+	uploader  *s3manager.Uploader
+	bucket    string
+	keyPrefix string
+	dir       string
+	log       *zap.Logger
+
+	watcher     *fsnotify.Watcher
+	watchDone   chan struct{}
+	queue       chan string
+	workersDone sync.WaitGroup
+
+	mu     sync.Mutex
+	queued map[string]bool
+	sizes  map[string]int64 // segment name -> bytes, for uploaded segments
+	err    error            // first segment that failed every attempt
+}
+
+// startSegmentUploader starts watching dir. It must be called before ffmpeg
+// starts so no segment is missed.
+func startSegmentUploader(
+	ctx context.Context,
+	uploader *s3manager.Uploader,
+	bucket, keyPrefix, dir string,
+	log *zap.Logger,
+) (*segmentUploader, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+
+	s := &segmentUploader{
+		ctx:       ctx,
+		uploader:  uploader,
+		bucket:    bucket,
+		keyPrefix: keyPrefix,
+		dir:       dir,
+		log:       log,
+		watcher:   watcher,
+		watchDone: make(chan struct{}),
+		queue:     make(chan string, 64),
+		queued:    make(map[string]bool),
+		sizes:     make(map[string]int64),
+	}
+
+	for i := 0; i < segmentUploadWorkers; i++ {
+		s.workersDone.Add(1)
+		go s.work()
+	}
+	go s.watch()
+	return s, nil
+}
+
+func (s *segmentUploader) watch() {
+	defer close(s.watchDone)
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			// the rename from .tmp shows up as a Create of the final name
+			if event.Has(fsnotify.Create) {
+				s.enqueue(filepath.Base(event.Name))
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			// e.g. a queue overflow; the sweep in finish picks up anything missed
+			s.log.Warn("segment watcher error", zap.Error(err))
+		}
+	}
+}
+
+func (s *segmentUploader) enqueue(name string) {
+	if !strings.HasSuffix(name, ".m4s") {
+		return
+	}
+	s.mu.Lock()
+	if s.queued[name] {
+		s.mu.Unlock()
+		return
+	}
+	s.queued[name] = true
+	s.mu.Unlock()
+
+	s.queue <- name
+}
+
+func (s *segmentUploader) work() {
+	defer s.workersDone.Done()
+	for name := range s.queue {
+		localPath := filepath.Join(s.dir, name)
+		info, err := os.Stat(localPath)
+		if err == nil {
+			err = uploadWithRetry(s.ctx, s.uploader, s.bucket, path.Join(s.keyPrefix, name), localPath, "public, max-age=31536000, immutable", s.log)
+		}
+
+		s.mu.Lock()
+		if err != nil {
+			if s.err == nil {
+				s.err = fmt.Errorf("segment %s: %w", name, err)
+			}
+		} else {
+			s.sizes[name] = info.Size()
+		}
+		s.mu.Unlock()
+
+		if err == nil {
+			_ = os.Remove(localPath)
+		}
+	}
+}
+
+// finish waits for every segment ffmpeg wrote to be uploaded. It returns the
+// uploaded segment sizes, or an error if any segment could not be uploaded.
+func (s *segmentUploader) finish() (map[string]int64, error) {
+	s.stopWatching()
+
+	// sweep for segments whose events were lost
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.abort()
+		return nil, fmt.Errorf("scan %s: %w", s.dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			s.enqueue(entry.Name())
+		}
+	}
+
+	close(s.queue)
+	s.workersDone.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes, s.err
+}
+
+// abort stops the uploader without waiting for ffmpeg's remaining output,
+// e.g. after ffmpeg failed.
+func (s *segmentUploader) abort() {
+	s.stopWatching()
+	close(s.queue)
+	s.workersDone.Wait()
+}
+
+func (s *segmentUploader) stopWatching() {
+	s.watcher.Close()
+	<-s.watchDone
+}
+
+// uploadWithRetry uploads a file, retrying with exponential backoff.
+func uploadWithRetry(
+	ctx context.Context,
+	uploader *s3manager.Uploader,
+	bucket, key, localPath, cacheControl string,
+	log *zap.Logger,
+) error {
+	backoff := uploadBackoff
+	for attempt := 1; ; attempt++ {
+		err := uploadFile(ctx, uploader, bucket, key, localPath, cacheControl, log)
+		if err == nil || attempt == uploadAttempts {
+			return err
+		}
+		log.Warn("upload failed, retrying", zap.String("key", key), zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"context"
+	"os/exec"
+)
+
+// FfmpegSlots bounds how many ffmpeg processes run at once. One is shared by
+// every video the service transcodes at the same time, so the encodes and
+// the side jobs (posters, storyboard, preview, loudness and complexity
+// analysis) of concurrent videos can't together claim more ffmpeg processes
+// than the node has CPU for. A nil FfmpegSlots doesn't limit anything.
+type FfmpegSlots chan struct{}
+
+// NewFfmpegSlots returns room for n ffmpeg processes, at least one.
+func NewFfmpegSlots(n int) FfmpegSlots {
+	return make(FfmpegSlots, max(1, n))
+}
+
+// acquire waits for a free slot, giving up when ctx is done.
+func (s FfmpegSlots) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (s FfmpegSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// run runs cmd in a slot of its own.
+func (s FfmpegSlots) run(ctx context.Context, cmd *exec.Cmd) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+	return cmd.Run()
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+const (
+	// storyboardColumns and storyboardRows lay out the tiles of one sprite sheet.
+	storyboardColumns = 10
+	storyboardRows    = 10
+	// maxStoryboardFrames caps the tiles of long videos by widening the interval.
+	maxStoryboardFrames = 1000
+)
+
+// storyboardTileBox bounds each tile; it follows the source orientation like
+// the rungs of the ladder do.
+var storyboardTileBox = renditionSpec{Width: 160, Height: 90}
+
+// StoryboardOptions configures the seek-bar preview sprites.
+type StoryboardOptions struct {
+	// Interval is the number of seconds between two tiles; 0 disables storyboards.
+	Interval float64
+	// Format is the sprite sheet image format, "jpg" or "webp".
+	Format string
+}
+
+// storyboardLayout is the storyboard planned for one video.
+type storyboardLayout struct {
+	Interval   float64
+	TileWidth  int
+	TileHeight int
+	Frames     int
+}
+
+// planStoryboard sizes the tiles for source and picks the interval, widened
+// so no video produces more than maxStoryboardFrames tiles.
+func planStoryboard(interval float64, source videoProbe) storyboardLayout {
+	interval = math.Max(interval, source.Duration/maxStoryboardFrames)
+	tile := fitToSource(storyboardTileBox, source)
+
+	return storyboardLayout{
+		Interval:   interval,
+		TileWidth:  tile.Width,
+		TileHeight: tile.Height,
+		Frames:     max(1, int(math.Ceil(source.Duration/interval))),
+	}
+}
+
+// generateStoryboard extracts a frame every interval seconds, tiles the frames
+// into sprite sheets and uploads them with a thumbnails.vtt mapping each time
+// range to its region of a sheet. It returns the S3 key of the VTT file.
+func generateStoryboard(
+	ctx context.Context,
+	uploader *s3manager.Uploader,
+	bucket, stagingDir, keyPrefix, videoPath string,
+	opts StoryboardOptions,
+	source videoProbe,
+	slots FfmpegSlots,
+	logger *zap.Logger,
+) (string, error) {
+	storyboardDir := filepath.Join(stagingDir, "storyboard")
+	if err := os.MkdirAll(storyboardDir, 0755); err != nil {
+		return "", err
+	}
+
+	layout := planStoryboard(opts.Interval, source)
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,setsar=1%s,tile=%dx%d",
+		strconv.FormatFloat(layout.Interval, 'f', -1, 64),
+		layout.TileWidth, layout.TileHeight, sdrFilter(source), storyboardColumns, storyboardRows)
+
+	args := []string{"-y", "-i", videoPath, "-an", "-sn", "-vf", filter}
+	switch opts.Format {
+	case "webp":
+		args = append(args, "-c:v", "libwebp", "-quality", "70")
+	default:
+		args = append(args, "-q:v", "4")
+	}
+	args = append(args, "-start_number", "0", filepath.Join(storyboardDir, "sprite_%03d."+opts.Format))
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+	if err := slots.run(ctx, cmd); err != nil {
+		return "", fmt.Errorf("ffmpeg storyboard: %w", err)
+	}
+
+	sheets, err := filepath.Glob(filepath.Join(storyboardDir, "sprite_*."+opts.Format))
+	if err != nil {
+		return "", err
+	}
+	if len(sheets) == 0 {
+		return "", fmt.Errorf("ffmpeg produced no sprite sheets")
+	}
+
+	// the last sheet is padded, so never point past the frames that exist
+	layout.Frames = min(layout.Frames, len(sheets)*storyboardColumns*storyboardRows)
+	vttPath := filepath.Join(storyboardDir, "thumbnails.vtt")
+	if err := os.WriteFile(vttPath, []byte(storyboardVTT(layout, source.Duration, opts.Format)), 0644); err != nil {
+		return "", err
+	}
+
+	for _, sheet := range sheets {
+		key := path.Join(keyPrefix, filepath.Base(sheet))
+		if err := uploadFile(ctx, uploader, bucket, key, sheet, "public, max-age=31536000, immutable", logger); err != nil {
+			return "", err
+		}
+	}
+	vttKey := path.Join(keyPrefix, "thumbnails.vtt")
+	if err := uploadFile(ctx, uploader, bucket, vttKey, vttPath, "public, max-age=31536000", logger); err != nil {
+		return "", err
+	}
+
+	logger.Info("storyboard uploaded", zap.Int("sheets", len(sheets)), zap.Int("frames", layout.Frames), zap.Float64("interval", layout.Interval))
+	return vttKey, nil
+}
+
+// storyboardVTT maps each tile's time range to its sprite#xywh= region.
+// Sprite URLs are relative to the VTT file, which sits next to the sheets.
+func storyboardVTT(layout storyboardLayout, duration float64, format string) string {
+	perSheet := storyboardColumns * storyboardRows
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < layout.Frames; i++ {
+		start := float64(i) * layout.Interval
+		end := math.Min(start+layout.Interval, duration)
+		if end <= start {
+			break
+		}
+
+		tile := i % perSheet
+		fmt.Fprintf(&b, "\n%s --> %s\nsprite_%03d.%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end),
+			i/perSheet, format,
+			(tile%storyboardColumns)*layout.TileWidth, (tile/storyboardColumns)*layout.TileHeight,
+			layout.TileWidth, layout.TileHeight)
+	}
+	return b.String()
+}
@@ -0,0 +1,301 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// subtitleSegmentSeconds is the length of each WebVTT segment. Subtitles are
+// tiny, so longer segments than the video's keep the object count down.
+const subtitleSegmentSeconds = 30
+
+// subtitleGroupID names the EXT-X-MEDIA group holding the subtitle rendition.
+const subtitleGroupID = "subs"
+
+// masterCacheControl is shorter than the segments' because the master playlist
+// is rewritten when captions arrive after the transcode finished.
+const masterCacheControl = "public, max-age=60"
+
+// subtitleTrack describes a subtitle rendition under the video's prefix.
+type subtitleTrack struct {
+	Dir      string // relative to the video's prefix, holds index.m3u8
+	Language string
+	Name     string
+}
+
+// captionsTrack is the rendition built from the captions service output,
+// which always transcribes en-US.
+var captionsTrack = subtitleTrack{Dir: "subtitles/en", Language: "en", Name: "English (auto-generated)"}
+
+// vttCue is a single WebVTT cue, kept verbatim apart from its timing.
+type vttCue struct {
+	Start, End float64
+	Settings   string
+	Payload    string
+}
+
+// AttachCaptions segments the captions of a video into an HLS subtitle
+// rendition and, if the video's master playlist already exists, rewrites it
+// to reference the subtitles. When the transcode hasn't finished yet the
+// master is left alone; Process picks the subtitles up when it writes it.
+func AttachCaptions(
+	ctx context.Context,
+	event types.CaptionsReadyEvent,
+	bucketName, transcodedPrefix string,
+	s3Client *s3.S3,
+	logger *zap.Logger,
+) error {
+	log := logger.With(zap.String("videoId", event.VideoId), zap.String("vttKey", event.VTTKey))
+
+	raw, err := getObject(ctx, s3Client, bucketName, event.VTTKey)
+	if err != nil {
+		return fmt.Errorf("download captions: %w", err)
+	}
+
+	cues, err := parseVTT(raw)
+	if err != nil {
+		return fmt.Errorf("parse captions: %w", err)
+	}
+	if len(cues) == 0 {
+		log.Info("captions have no cues, nothing to attach")
+		return nil
+	}
+
+	trackPrefix := path.Join(transcodedPrefix, event.VideoId, captionsTrack.Dir)
+	segments, playlist := segmentVTT(cues)
+	for name, body := range segments {
+		if err := putObject(ctx, s3Client, bucketName, path.Join(trackPrefix, name), body, "public, max-age=31536000, immutable"); err != nil {
+			return fmt.Errorf("upload subtitle segment: %w", err)
+		}
+	}
+	if err := putObject(ctx, s3Client, bucketName, path.Join(trackPrefix, "index.m3u8"), playlist, "public, max-age=31536000"); err != nil {
+		return fmt.Errorf("upload subtitle playlist: %w", err)
+	}
+	log.Info("subtitle rendition uploaded", zap.Int("segments", len(segments)))
+
+	masterKey := path.Join(transcodedPrefix, event.VideoId, "master.m3u8")
+	master, err := getObject(ctx, s3Client, bucketName, masterKey)
+	if isNotFound(err) {
+		log.Info("master playlist not written yet, transcoder will attach subtitles")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("download master playlist: %w", err)
+	}
+
+	updated := withSubtitles(string(master), captionsTrack)
+	if err := putObject(ctx, s3Client, bucketName, masterKey, []byte(updated), masterCacheControl); err != nil {
+		return fmt.Errorf("upload master playlist: %w", err)
+	}
+	log.Info("master playlist updated with subtitles")
+	return nil
+}
+
+// attachReadySubtitles adds the captions rendition to a locally written
+// master playlist if the captions service has already produced it. It
+// reports whether the subtitles were found.
+func attachReadySubtitles(ctx context.Context, s3Client *s3.S3, bucketName, transcodedPrefix, videoID, masterPath string) (bool, error) {
+	_, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(path.Join(transcodedPrefix, videoID, captionsTrack.Dir, "index.m3u8")),
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("check subtitle playlist: %w", err)
+	}
+
+	master, err := os.ReadFile(masterPath)
+	if err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(masterPath, []byte(withSubtitles(string(master), captionsTrack)), 0644)
+}
+
+// withSubtitles returns the master playlist with track as its only subtitle
+// rendition, referenced from every variant. Rewriting is idempotent.
+func withSubtitles(master string, track subtitleTrack) string {
+	media := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI=\"%s/index.m3u8\"",
+		subtitleGroupID, quotedAttribute(track.Name), track.Language, track.Dir)
+
+	var out []string
+	inserted := false
+	for _, line := range strings.Split(strings.TrimRight(master, "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:") && strings.Contains(line, "TYPE=SUBTITLES") {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !inserted {
+				out = append(out, media)
+				inserted = true
+			}
+			line = removeAttribute(line, "SUBTITLES") + fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroupID)
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// removeAttribute drops key from an HLS tag line such as #EXT-X-STREAM-INF.
+func removeAttribute(line, key string) string {
+	tag, attributes, ok := strings.Cut(line, ":")
+	if !ok {
+		return line
+	}
+
+	var kept []string
+	for _, pair := range splitAttributes(attributes) {
+		if name, _, _ := strings.Cut(pair, "="); name == key {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return tag + ":" + strings.Join(kept, ",")
+}
+
+// parseVTT extracts the cues of a WebVTT file, dropping NOTE, STYLE and
+// REGION blocks.
+func parseVTT(raw []byte) ([]vttCue, error) {
+	raw = bytes.TrimPrefix(raw, []byte("\ufeff"))
+	if !bytes.HasPrefix(raw, []byte("WEBVTT")) {
+		return nil, errors.New("missing WEBVTT header")
+	}
+
+	var cues []vttCue
+	blocks := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n\n")
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// an optional identifier line precedes the timing line
+		timing := 0
+		if !strings.Contains(lines[0], "-->") {
+			timing = 1
+		}
+		if timing >= len(lines) || !strings.Contains(lines[timing], "-->") {
+			continue
+		}
+
+		startText, rest, _ := strings.Cut(lines[timing], "-->")
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("malformed cue timing %q", lines[timing])
+		}
+		start, err := parseVTTTimestamp(strings.TrimSpace(startText))
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseVTTTimestamp(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		cues = append(cues, vttCue{
+			Start:    start,
+			End:      end,
+			Settings: strings.Join(fields[1:], " "),
+			Payload:  strings.Join(lines[timing+1:], "\n"),
+		})
+	}
+	return cues, nil
+}
+
+// segmentVTT splits cues into subtitleSegmentSeconds long WebVTT segments and
+// builds their media playlist. A cue spanning a boundary is repeated in each
+// segment it overlaps, which players de-duplicate.
+func segmentVTT(cues []vttCue) (map[string][]byte, []byte) {
+	var total float64
+	for _, cue := range cues {
+		total = math.Max(total, cue.End)
+	}
+	count := max(1, int(math.Ceil(total/subtitleSegmentSeconds)))
+
+	segments := make(map[string][]byte, count)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", subtitleSegmentSeconds)
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	for i := 0; i < count; i++ {
+		start := float64(i * subtitleSegmentSeconds)
+		end := math.Min(start+subtitleSegmentSeconds, total)
+
+		var b strings.Builder
+		// every rendition is encoded with its timeline starting at zero (see
+		// hlsOutputArgs), so local time maps 1:1
+		b.WriteString("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n")
+		for _, cue := range cues {
+			if cue.Start >= end || cue.End <= start {
+				continue
+			}
+			fmt.Fprintf(&b, "\n%s --> %s", formatVTTTimestamp(cue.Start), formatVTTTimestamp(cue.End))
+			if cue.Settings != "" {
+				b.WriteString(" " + cue.Settings)
+			}
+			b.WriteString("\n" + cue.Payload + "\n")
+		}
+
+		name := fmt.Sprintf("seg_%05d.vtt", i)
+		segments[name] = []byte(b.String())
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", end-start, name)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	return segments, []byte(playlist.String())
+}
+
+// parseVTTTimestamp parses hh:mm:ss.ttt or mm:ss.ttt into seconds.
+func parseVTTTimestamp(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("malformed timestamp %q", s)
+	}
+	var seconds float64
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed timestamp %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+func formatVTTTimestamp(sec float64) string {
+	ms := int64(math.Round(sec * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func putObject(ctx context.Context, s3Client *s3.S3, bucket, key string, body []byte, cacheControl string) error {
+	_, err := s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(body),
+		ContentType:  aws.String(contentTypeFor(key)),
+		CacheControl: aws.String(cacheControl),
+	})
+	return err
+}
+
+// isNotFound reports whether err is S3's answer for a missing key.
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+}
@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVTT(t *testing.T) {
+	raw := "\ufeffWEBVTT\r\n\r\nNOTE generated\r\n\r\n1\r\n00:00:01.000 --> 00:00:03.500 align:start line:0\r\nhello\r\nworld\r\n\r\n01:02.250 --> 01:04.000\r\nagain\r\n"
+
+	cues, err := parseVTT([]byte(raw))
+	if err != nil {
+		t.Fatalf("parseVTT: %v", err)
+	}
+	want := []vttCue{
+		{Start: 1, End: 3.5, Settings: "align:start line:0", Payload: "hello\nworld"},
+		{Start: 62.25, End: 64, Payload: "again"},
+	}
+	if !reflect.DeepEqual(cues, want) {
+		t.Errorf("parseVTT = %+v, want %+v", cues, want)
+	}
+
+	if _, err := parseVTT([]byte("1\n00:00:01.000 --> 00:00:02.000\nhi\n")); err == nil {
+		t.Error("parseVTT accepted a file without the WEBVTT header")
+	}
+	if _, err := parseVTT([]byte("WEBVTT\n\n00:00:xx --> 00:00:02.000\nhi\n")); err == nil {
+		t.Error("parseVTT accepted a malformed timestamp")
+	}
+}
+
+func TestSegmentVTT(t *testing.T) {
+	cues := []vttCue{
+		{Start: 1, End: 3, Payload: "first"},
+		{Start: 28, End: 33, Settings: "align:start", Payload: "across the boundary"},
+		{Start: 45, End: 50, Payload: "last"},
+	}
+	segments, playlist := segmentVTT(cues)
+
+	const header = "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n"
+	want := map[string]string{
+		"seg_00000.vtt": header +
+			"\n00:00:01.000 --> 00:00:03.000\nfirst\n" +
+			"\n00:00:28.000 --> 00:00:33.000 align:start\nacross the boundary\n",
+		"seg_00001.vtt": header +
+			"\n00:00:28.000 --> 00:00:33.000 align:start\nacross the boundary\n" +
+			"\n00:00:45.000 --> 00:00:50.000\nlast\n",
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("segmentVTT made %d segments, want %d", len(segments), len(want))
+	}
+	for name, body := range want {
+		if got := string(segments[name]); got != body {
+			t.Errorf("%s =\n%s\nwant\n%s", name, got, body)
+		}
+	}
+
+	parsed, err := readMediaPlaylist(bytes.NewReader(playlist), "subtitles")
+	if err != nil {
+		t.Fatalf("read subtitle playlist: %v", err)
+	}
+	wantSegments := []mediaSegment{{URI: "seg_00000.vtt", Duration: 30}, {URI: "seg_00001.vtt", Duration: 20}}
+	if !reflect.DeepEqual(parsed.Segments, wantSegments) || parsed.TargetDuration != subtitleSegmentSeconds || !parsed.EndList {
+		t.Errorf("subtitle playlist = %+v, want segments %+v ending the list", parsed, wantSegments)
+	}
+}
+
+func TestFormatVTTTimestamp(t *testing.T) {
+	tests := map[float64]string{
+		0:        "00:00:00.000",
+		1.5:      "00:00:01.500",
+		62.25:    "00:01:02.250",
+		3723.004: "01:02:03.004",
+	}
+	for sec, want := range tests {
+		if got := formatVTTTimestamp(sec); got != want {
+			t.Errorf("formatVTTTimestamp(%v) = %q, want %q", sec, got, want)
+		}
+		if back, err := parseVTTTimestamp(want); err != nil || math.Abs(back-sec) > 1e-9 {
+			t.Errorf("parseVTTTimestamp(%q) = %v, %v; want %v", want, back, err, sec)
+		}
+	}
+}
+
+func TestWithSubtitles(t *testing.T) {
+	master := "#EXTM3U\n" +
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"old\",NAME=\"Old\",URI=\"old/index.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000000,CODECS=\"avc1.640028,mp4a.40.2\",SUBTITLES=\"old\"\n" +
+		"720p/index.m3u8\n"
+
+	once := withSubtitles(master, captionsTrack)
+	if strings.Contains(once, "old") {
+		t.Errorf("withSubtitles kept the previous subtitle group:\n%s", once)
+	}
+	if !strings.Contains(once, `URI="subtitles/en/index.m3u8"`) || !strings.Contains(once, `CODECS="avc1.640028,mp4a.40.2",SUBTITLES="subs"`) {
+		t.Errorf("withSubtitles didn't reference the captions track:\n%s", once)
+	}
+	if twice := withSubtitles(once, captionsTrack); twice != once {
+		t.Errorf("withSubtitles isn't idempotent:\n%s\nthen\n%s", once, twice)
+	}
+}
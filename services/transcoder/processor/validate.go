@@ -0,0 +1,262 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// Machine-readable reasons an upload is rejected for. They are published as
+// the FailureReason of the terminal "failed" status.
+const (
+	ReasonEmptyFile            = "empty_file"
+	ReasonUnreadable           = "unreadable"
+	ReasonTruncated            = "truncated"
+	ReasonNoVideoStream        = "no_video_stream"
+	ReasonDurationExceeded     = "duration_exceeded"
+	ReasonResolutionExceeded   = "resolution_exceeded"
+	ReasonUnsupportedCodec     = "unsupported_codec"
+	ReasonUnsupportedContainer = "unsupported_container"
+	ReasonUnknownProfile       = "unknown_profile"
+	ReasonInvalidOverlay       = "invalid_overlay"
+	// ReasonRetriesExhausted is reported by the consumer once a request
+	// failed too many times for reasons not known to be permanent.
+	ReasonRetriesExhausted = "retries_exhausted"
+)
+
+// errNoVideoStream is returned by probeVideo for files without a usable video stream.
+var errNoVideoStream = errors.New("no video stream with known dimensions")
+
+// mediaErrorPatterns are what ffprobe and ffmpeg log when the file itself is
+// broken or cut short, as opposed to the tool failing to run.
+var mediaErrorPatterns = []string{
+	"invalid data found when processing input",
+	"moov atom not found",
+	"could not find codec parameters",
+	"ebml header parsing failed",
+	"partial file",
+	"stream ends prematurely",
+}
+
+// toolError is a failed ffprobe or ffmpeg run together with what it logged.
+type toolError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *toolError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, strings.TrimSpace(e.Stderr))
+}
+
+func (e *toolError) Unwrap() error {
+	return e.Err
+}
+
+// mediaProblem reports whether the run failed over the file: the tool exited
+// by itself with an error status and logged one of mediaErrorPatterns. A
+// missing binary, a kill by signal (e.g. the OOM killer) or anything else is
+// an infrastructure failure worth retrying.
+func (e *toolError) mediaProblem() bool {
+	var exit *exec.ExitError
+	if !errors.As(e.Err, &exit) || !exit.Exited() {
+		return false
+	}
+	return hasMediaError(e.Stderr)
+}
+
+func hasMediaError(log string) bool {
+	log = strings.ToLower(log)
+	for _, pattern := range mediaErrorPatterns {
+		if strings.Contains(log, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidationError means the request can never succeed, so it must not be
+// retried. Reason is one of the Reason constants.
+type ValidationError struct {
+	Reason string
+	Detail string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Detail == "" {
+		return "invalid upload: " + e.Reason
+	}
+	return fmt.Sprintf("invalid upload: %s: %s", e.Reason, e.Detail)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Limits bounds what the transcoder accepts. Zero values disable a limit.
+type Limits struct {
+	// MaxDuration is the longest accepted video in seconds.
+	MaxDuration float64
+	// MaxDimension caps the longer edge of the video in pixels.
+	MaxDimension int
+	// AllowedVideoCodecs and AllowedContainers are ffprobe codec and format
+	// names; empty allows anything ffmpeg can decode.
+	AllowedVideoCodecs []string
+	AllowedContainers  []string
+}
+
+// validateSource probes the downloaded upload and checks it can be transcoded.
+// Uploads that never can are reported as a *ValidationError.
+func validateSource(ctx context.Context, localPath string, limits Limits) (videoProbe, error) {
+	if err := validateDownload(localPath); err != nil {
+		return videoProbe{}, err
+	}
+	probe, err := probeVideo(ctx, localPath)
+	if err != nil {
+		return videoProbe{}, probeFailure(ctx, err)
+	}
+	if err := validateProbe(probe, limits); err != nil {
+		return videoProbe{}, err
+	}
+	if err := checkDecodable(ctx, localPath); err != nil {
+		return videoProbe{}, err
+	}
+	return probe, nil
+}
+
+// validateDownload rejects empty files before anything is spent probing them.
+func validateDownload(localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return &ValidationError{Reason: ReasonEmptyFile}
+	}
+	return nil
+}
+
+// probeFailure turns a probeVideo error into a ValidationError when the file
+// is at fault. Cancellation and ffprobe failing to run are returned as they
+// are so the request is retried.
+func probeFailure(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	if errors.Is(err, errNoVideoStream) {
+		return &ValidationError{Reason: ReasonNoVideoStream, Err: err}
+	}
+	var run *toolError
+	if errors.As(err, &run) && !run.mediaProblem() {
+		return fmt.Errorf("ffprobe: %w", err)
+	}
+	// ffprobe ran but its output doesn't describe a usable file
+	return &ValidationError{Reason: ReasonUnreadable, Detail: err.Error(), Err: err}
+}
+
+// validateProbe checks the probed source against limits.
+func validateProbe(probe videoProbe, limits Limits) error {
+	meta := probe.Metadata
+	if probe.Duration <= 0 {
+		return &ValidationError{Reason: ReasonUnreadable, Detail: "unknown duration"}
+	}
+	if limits.MaxDuration > 0 && probe.Duration > limits.MaxDuration {
+		return &ValidationError{
+			Reason: ReasonDurationExceeded,
+			Detail: fmt.Sprintf("%.0fs exceeds %.0fs", probe.Duration, limits.MaxDuration),
+		}
+	}
+	if limits.MaxDimension > 0 && max(meta.Video.Width, meta.Video.Height) > limits.MaxDimension {
+		return &ValidationError{
+			Reason: ReasonResolutionExceeded,
+			Detail: fmt.Sprintf("%dx%d exceeds %dpx", meta.Video.Width, meta.Video.Height, limits.MaxDimension),
+		}
+	}
+	if len(limits.AllowedVideoCodecs) > 0 && !containsAny(limits.AllowedVideoCodecs, meta.Video.Codec) {
+		return &ValidationError{Reason: ReasonUnsupportedCodec, Detail: meta.Video.Codec}
+	}
+	// ffprobe names a demuxer by every format it handles, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	if len(limits.AllowedContainers) > 0 && !containsAny(limits.AllowedContainers, strings.Split(meta.Container, ",")...) {
+		return &ValidationError{Reason: ReasonUnsupportedContainer, Detail: meta.Container}
+	}
+	return nil
+}
+
+// checkDecodable decodes the last seconds of the video stream to catch
+// truncated uploads whose header still probes fine. Decode errors alone
+// don't fail it: the first frames after the seek may reference pictures
+// before it (open GOPs), which decoders complain about on healthy files.
+// Only the demuxer running out of file counts.
+func checkDecodable(ctx context.Context, localPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-sseof", "-5", "-i", localPath,
+		"-map", "0:v:0", "-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	run := &toolError{Err: err, Stderr: stderr.String()}
+	switch {
+	case err == nil && hasMediaError(run.Stderr), err != nil && run.mediaProblem():
+		return &ValidationError{Reason: ReasonTruncated, Detail: strings.TrimSpace(run.Stderr), Err: err}
+	case err != nil:
+		return fmt.Errorf("decode check: %w", run)
+	}
+	return nil
+}
+
+// quarantineOriginal copies a rejected upload to the quarantine prefix so it
+// is kept for inspection, and tags the original with the rejection. The
+// original stays where it is: the captions service reads it in parallel and
+// may still be transcribing it.
+func quarantineOriginal(ctx context.Context, s3Client *s3.S3, bucket, originalKey, quarantineKey, reason string, logger *zap.Logger) {
+	_, err := s3Client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		CopySource:        aws.String((&url.URL{Path: path.Join(bucket, originalKey)}).EscapedPath()),
+		Key:               aws.String(quarantineKey),
+		Metadata:          map[string]*string{"rejection-reason": aws.String(reason)},
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		logger.Warn("failed to quarantine upload", zap.String("key", originalKey), zap.Error(err))
+		return
+	}
+
+	// the tag lets a lifecycle rule expire rejected originals once nothing reads them
+	if _, err := s3Client.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(originalKey),
+		Tagging: &s3.Tagging{TagSet: []*s3.Tag{
+			{Key: aws.String("rejection-reason"), Value: aws.String(reason)},
+		}},
+	}); err != nil {
+		logger.Warn("failed to tag rejected original", zap.String("key", originalKey), zap.Error(err))
+	}
+	logger.Info("upload quarantined", zap.String("key", quarantineKey), zap.String("reason", reason))
+}
+
+func containsAny(allowed []string, values ...string) bool {
+	for _, v := range values {
+		for _, a := range allowed {
+			if strings.EqualFold(a, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
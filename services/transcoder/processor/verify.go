@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// verifyConcurrency bounds the HEAD requests in flight while verifying.
+const verifyConcurrency = 16
+
+// PackageError lists what is wrong with an uploaded HLS package, keyed by
+// the directory of the broken media playlist relative to the video's prefix.
+type PackageError struct {
+	Problems map[string][]string
+}
+
+func (e *PackageError) Error() string {
+	dirs := make([]string, 0, len(e.Problems))
+	for dir := range e.Problems {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var parts []string
+	for _, dir := range dirs {
+		parts = append(parts, fmt.Sprintf("%s: %s", dir, strings.Join(e.Problems[dir], "; ")))
+	}
+	return "HLS package verification failed: " + strings.Join(parts, " | ")
+}
+
+// verifyPackage checks every media playlist the master playlist of a video
+// references, reading them back from S3 before the master itself is
+// published: each must be complete, keep its segments within the target
+// duration and reference only objects that exist with a non-zero size.
+// Problems are returned as a *PackageError.
+func verifyPackage(ctx context.Context, s3Client *s3.S3, bucket, transcodedPrefix, videoID string, master []byte, logger *zap.Logger) error {
+	videoPrefix := path.Join(transcodedPrefix, videoID)
+
+	playlists := masterPlaylistURIs(master)
+	if len(playlists) == 0 {
+		return &PackageError{Problems: map[string][]string{".": {"master playlist references no media playlists"}}}
+	}
+
+	problems := make(map[string][]string)
+	var mu sync.Mutex
+	report := func(dir, problem string) {
+		mu.Lock()
+		problems[dir] = append(problems[dir], problem)
+		mu.Unlock()
+	}
+
+	// every object that has to exist, with the playlist dir it belongs to
+	type reference struct{ dir, key string }
+	var references []reference
+	for _, uri := range playlists {
+		dir := path.Dir(uri)
+		raw, err := getObject(ctx, s3Client, bucket, path.Join(videoPrefix, uri))
+		if isNotFound(err) {
+			report(dir, "media playlist missing")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read media playlist %s: %w", uri, err)
+		}
+
+		playlist, err := readMediaPlaylist(bytes.NewReader(raw), uri)
+		if err != nil {
+			report(dir, err.Error())
+			continue
+		}
+		if !playlist.EndList {
+			report(dir, "missing #EXT-X-ENDLIST")
+		}
+		if playlist.TargetDuration <= 0 {
+			report(dir, "missing #EXT-X-TARGETDURATION")
+		}
+		if playlist.InitURI != "" {
+			references = append(references, reference{dir, path.Join(videoPrefix, dir, playlist.InitURI)})
+		}
+		for _, seg := range playlist.Segments {
+			// HLS requires every EXTINF, rounded, to be within the target duration
+			if seg.Duration <= 0 || int(math.Round(seg.Duration)) > playlist.TargetDuration {
+				report(dir, fmt.Sprintf("%s lasts %.3fs, target duration is %ds", seg.URI, seg.Duration, playlist.TargetDuration))
+			}
+			references = append(references, reference{dir, path.Join(videoPrefix, dir, seg.URI)})
+		}
+	}
+
+	slots := make(chan struct{}, verifyConcurrency)
+	var wg sync.WaitGroup
+	var headErr error
+	for _, ref := range references {
+		wg.Add(1)
+		go func(ref reference) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			head, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(ref.key),
+			})
+			switch {
+			case isNotFound(err):
+				report(ref.dir, path.Base(ref.key)+" missing")
+			case err != nil:
+				mu.Lock()
+				if headErr == nil {
+					headErr = fmt.Errorf("head %s: %w", ref.key, err)
+				}
+				mu.Unlock()
+			case aws.Int64Value(head.ContentLength) == 0:
+				report(ref.dir, path.Base(ref.key)+" is empty")
+			}
+		}(ref)
+	}
+	wg.Wait()
+
+	if len(problems) > 0 {
+		return &PackageError{Problems: problems}
+	}
+	if headErr != nil {
+		return headErr
+	}
+
+	logger.Info("HLS package verified", zap.Int("playlists", len(playlists)), zap.Int("objects", len(references)))
+	return nil
+}
+
+// masterPlaylistURIs returns the media playlists referenced by a master
+// playlist, both variant streams and EXT-X-MEDIA renditions, deduplicated.
+func masterPlaylistURIs(master []byte) []string {
+	seen := make(map[string]bool)
+	var uris []string
+	add := func(uri string) {
+		if uri != "" && !seen[uri] {
+			seen[uri] = true
+			uris = append(uris, uri)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(master))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			add(attributeValue(strings.TrimPrefix(line, "#EXT-X-MEDIA:"), "URI"))
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		default:
+			add(line)
+		}
+	}
+	return uris
+}
+
+func getObject(ctx context.Context, s3Client *s3.S3, bucket, key string) ([]byte, error) {
+	obj, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
+}
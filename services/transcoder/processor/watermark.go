@@ -0,0 +1,236 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/GoyalIshaan/vidSmith/services/transcoder/types"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// watermarkFont is the font the text watermark is drawn in; the image
+// installs it with the font-dejavu package.
+const watermarkFont = "/usr/share/fonts/dejavu/DejaVuSans-Bold.ttf"
+
+const (
+	defaultWatermarkPosition = "bottom-right"
+	defaultWatermarkOpacity  = 0.8
+	// maxWatermarkText caps the text so it fits across a portrait frame.
+	maxWatermarkText = 64
+	// The logo width, the margin to the frame edge and the font size are
+	// shares of the frame's shorter edge, so the watermark looks the same on
+	// every rung.
+	watermarkLogoShare   = 0.15
+	watermarkMarginShare = 0.03
+	watermarkFontShare   = 0.04
+)
+
+// watermarkPositions lists the corners, and the centre, a watermark can sit in.
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true,
+}
+
+// watermarkImageExtensions are the logo file types kept in the staged name.
+var watermarkImageExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".webp": true}
+
+// watermark is the overlay of a request, ready to be drawn by the encodes.
+// Its files sit in the staging directory, named after their content so the
+// checkpoint fingerprints change with the watermark.
+type watermark struct {
+	// Image is the logo's path relative to the encodes' working directories,
+	// "" for none; ImageWidth and ImageHeight are its size.
+	Image       string
+	ImageWidth  int
+	ImageHeight int
+	// TextFile holds the text, read by drawtext so it needs no escaping.
+	TextFile string
+	Position string
+	Opacity  float64
+}
+
+// prepareWatermark checks the overlay of a request and stages its logo and
+// text for the encodes. The logo must sit under overlayPrefix, so a request
+// can't burn any other object of the bucket into a public rendition.
+// Overlays that can never be drawn are reported as a *ValidationError. A nil
+// overlay returns a nil watermark.
+func prepareWatermark(ctx context.Context, s3Client *s3.S3, bucket, overlayPrefix, stagingDir string, overlay *types.OverlayOptions) (*watermark, error) {
+	if overlay == nil || (overlay.ImageKey == "" && overlay.Text == "") {
+		return nil, nil
+	}
+	invalid := func(detail string) error {
+		return &ValidationError{Reason: ReasonInvalidOverlay, Detail: detail}
+	}
+
+	w := &watermark{Position: overlay.Position, Opacity: overlay.Opacity}
+	if w.Position == "" {
+		w.Position = defaultWatermarkPosition
+	}
+	if !watermarkPositions[w.Position] {
+		return nil, invalid(fmt.Sprintf("unknown position %q", overlay.Position))
+	}
+	if w.Opacity == 0 {
+		w.Opacity = defaultWatermarkOpacity
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return nil, invalid(fmt.Sprintf("opacity %g out of range 0-1", overlay.Opacity))
+	}
+
+	if overlay.Text != "" {
+		text := strings.TrimSpace(overlay.Text)
+		if len([]rune(text)) > maxWatermarkText {
+			return nil, invalid(fmt.Sprintf("text longer than %d characters", maxWatermarkText))
+		}
+		if strings.IndexFunc(text, unicode.IsControl) >= 0 {
+			return nil, invalid("text contains control characters")
+		}
+		name, err := stageWatermarkFile(stagingDir, ".txt", []byte(text))
+		if err != nil {
+			return nil, err
+		}
+		w.TextFile = filepath.Join("..", name)
+	}
+
+	if overlay.ImageKey != "" {
+		if !underPrefix(overlay.ImageKey, overlayPrefix) {
+			return nil, invalid(fmt.Sprintf("image %s is not under %s/", overlay.ImageKey, strings.Trim(overlayPrefix, "/")))
+		}
+		image, err := getObject(ctx, s3Client, bucket, overlay.ImageKey)
+		if isNotFound(err) {
+			return nil, invalid(fmt.Sprintf("image %s not found", overlay.ImageKey))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("download watermark image: %w", err)
+		}
+		// the extension helps ffmpeg pick the image demuxer; anything odd is left to probing
+		ext := strings.ToLower(path.Ext(overlay.ImageKey))
+		if !watermarkImageExtensions[ext] {
+			ext = ""
+		}
+		name, err := stageWatermarkFile(stagingDir, ext, image)
+		if err != nil {
+			return nil, err
+		}
+		w.ImageWidth, w.ImageHeight, err = probeDimensions(ctx, filepath.Join(stagingDir, name))
+		if err != nil {
+			return nil, invalid(fmt.Sprintf("image %s is not readable: %v", overlay.ImageKey, err))
+		}
+		w.Image = filepath.Join("..", name)
+	}
+	return w, nil
+}
+
+// underPrefix reports whether key is a plain object key inside prefix: no
+// leading slash, no . or .. segments and not the prefix itself.
+func underPrefix(key, prefix string) bool {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." || segment == "." {
+			return false
+		}
+	}
+	return strings.HasPrefix(key, prefix+"/")
+}
+
+// stageWatermarkFile writes data to the staging directory under a name
+// derived from its content and returns the name. Encodes run in their own
+// directories right under the staging directory, so they refer to it as
+// ../<name>.
+func stageWatermarkFile(stagingDir, ext string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	name := "watermark-" + hex.EncodeToString(sum[:8]) + ext
+	if err := os.WriteFile(filepath.Join(stagingDir, name), data, 0644); err != nil {
+		return "", fmt.Errorf("stage watermark: %w", err)
+	}
+	return name, nil
+}
+
+// inputArgs adds the logo as the encode's second input. Overlay repeats its
+// single frame for the length of the video.
+func (w *watermark) inputArgs() []string {
+	if w.Image == "" {
+		return nil
+	}
+	return []string{"-i", w.Image}
+}
+
+// filterGraph draws the watermark over the rung's video, which base converts
+// and scales, and labels the result [v]. The logo and text are sized by the
+// rung's shorter edge; when both are drawn the text sits next to the logo
+// on the side away from the frame edge.
+func (w *watermark) filterGraph(base string, r renditionSpec) string {
+	short := float64(min(r.Width, r.Height))
+	margin := int(math.Round(short * watermarkMarginShare))
+
+	var logoWidth, logoHeight int
+	if w.Image != "" {
+		logoWidth = evenDimension(short * watermarkLogoShare)
+		logoHeight = evenDimension(float64(logoWidth) * float64(w.ImageHeight) / float64(w.ImageWidth))
+	}
+
+	// SDR white would be blinding on an HDR rung; scale it to HDR reference
+	// white instead, about 58% of the PQ signal range and 75% of HLG's
+	white := map[string]float64{videoRangePQ: 0.58, videoRangeHLG: 0.75}[r.VideoRange]
+	if white == 0 {
+		white = 1
+	}
+	gray := int(math.Round(white * 255))
+
+	chain := "[0:v:0]" + base
+	if w.TextFile != "" {
+		// the text goes below a logo at the top and above one at the bottom
+		offset := 0
+		if logoHeight > 0 {
+			offset = logoHeight + margin/2
+		}
+		x, y := watermarkPlacement(w.Position, "w", "h", "text_w", "text_h", margin, offset)
+		chain += fmt.Sprintf(
+			",drawtext=fontfile=%s:textfile=%s:expansion=none:fontsize=%d:fontcolor=0x%02X%02X%02X@%.2f:shadowcolor=black@%.2f:shadowx=2:shadowy=2:x=%s:y=%s",
+			watermarkFont, w.TextFile, max(8, int(math.Round(short*watermarkFontShare))),
+			gray, gray, gray, w.Opacity, w.Opacity*0.6, x, y,
+		)
+	}
+	if w.Image == "" {
+		return chain + "[v]"
+	}
+
+	x, y := watermarkPlacement(w.Position, "main_w", "main_h", "overlay_w", "overlay_h", margin, 0)
+	return chain + "[base];" +
+		fmt.Sprintf("[1:v]scale=%d:%d,format=rgba,colorchannelmixer=rr=%.2f:gg=%.2f:bb=%.2f:aa=%.2f[logo];",
+			logoWidth, logoHeight, white, white, white, w.Opacity) +
+		fmt.Sprintf("[base][logo]overlay=x=%s:y=%s:format=auto[v]", x, y)
+}
+
+// watermarkPlacement returns the x and y expressions that put an element of
+// size width x height in position within a frame of frameW x frameH, all
+// named as the filter calls them. It keeps margin pixels to the frame edge
+// and moves offset pixels further towards the centre vertically.
+func watermarkPlacement(position, frameW, frameH, width, height string, margin, offset int) (string, string) {
+	left := fmt.Sprint(margin)
+	right := fmt.Sprintf("%s-%s-%d", frameW, width, margin)
+	top := fmt.Sprint(margin + offset)
+	bottom := fmt.Sprintf("%s-%s-%d", frameH, height, margin+offset)
+
+	switch position {
+	case "top-left":
+		return left, top
+	case "top-right":
+		return right, top
+	case "bottom-left":
+		return left, bottom
+	case "bottom-right":
+		return right, bottom
+	default:
+		return fmt.Sprintf("(%s-%s)/2", frameW, width), fmt.Sprintf("(%s-%s)/2+%d", frameH, height, offset)
+	}
+}
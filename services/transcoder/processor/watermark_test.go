@@ -0,0 +1,28 @@
+package processor
+
+import "testing"
+
+func TestUnderPrefix(t *testing.T) {
+	tests := []struct {
+		key, prefix string
+		want        bool
+	}{
+		{"overlays/logo.png", "overlays", true},
+		{"overlays/brand/logo.png", "overlays", true},
+		{"overlays/logo.png", "/overlays/", true},
+		{"overlays", "overlays", false},
+		{"overlays/", "overlays", false},
+		{"overlaysx/logo.png", "overlays", false},
+		{"uploads/video.mp4", "overlays", false},
+		{"overlays/../uploads/video.mp4", "overlays", false},
+		{"overlays/./logo.png", "overlays", false},
+		{"overlays//logo.png", "overlays", false},
+		{"/overlays/logo.png", "overlays", false},
+		{"overlays/logo.png", "", false},
+	}
+	for _, tt := range tests {
+		if got := underPrefix(tt.key, tt.prefix); got != tt.want {
+			t.Errorf("underPrefix(%q, %q) = %v, want %v", tt.key, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -10,14 +10,171 @@ import (
 type TranscodeRequest struct {
 	VideoId    string `json:"videoId"`
 	S3Key      string `json:"s3Key"`
+	// Profile selects an encoding ladder by name; empty means the default one.
+	Profile    string `json:"profile,omitempty"`
+	// Overlay stamps a watermark on every rendition; nil for none.
+	Overlay    *OverlayOptions `json:"overlay,omitempty"`
+}
+
+// OverlayOptions describes a watermark: a logo, a line of text or both.
+type OverlayOptions struct {
+	// ImageKey is the S3 key of the logo in the uploads bucket.
+	ImageKey string `json:"imageKey,omitempty"`
+	// Position is top-left, top-right, bottom-left, bottom-right (the
+	// default) or center.
+	Position string `json:"position,omitempty"`
+	// Opacity runs from 0 to 1; 0 means the default of 0.8.
+	Opacity float64 `json:"opacity,omitempty"`
+	// Text is drawn as is, e.g. a channel handle.
+	Text string `json:"text,omitempty"`
+}
+
+// CaptionsReadyEvent is published by the captions service once a video's
+// WebVTT file is in S3.
+type CaptionsReadyEvent struct {
+	VideoId    string `json:"VideoId"`
+	S3Key      string `json:"S3Key"`
+	VTTKey     string `json:"VTTKey"`
 }
 
 type UpdateVideoStatusEvent struct {
 	VideoId string `json:"VideoId"`
 	Phase string `json:"Phase"`	
 	ManifestKey string `json:"ManifestKey"`
+	DashKey string `json:"DashKey"`
 	ThumbnailKey string `json:"ThumbnailKey"`
+	// StoryboardKey is the thumbnails.vtt of the seek-bar previews; empty if none were made.
+	StoryboardKey string `json:"StoryboardKey,omitempty"`
+	// Posters offers poster choices, best first, each at several sizes and formats.
+	Posters []Poster `json:"Posters,omitempty"`
+	// PreviewKey and PreviewWebPKey are the muted hover preview as MP4 and
+	// animated WebP; empty if it couldn't be made.
+	PreviewKey string `json:"PreviewKey,omitempty"`
+	PreviewWebPKey string `json:"PreviewWebPKey,omitempty"`
 	VideoDuration float64 `json:"VideoDuration"`
+	// Metadata describes the uploaded source as probed before transcoding.
+	Metadata *MediaMetadata `json:"Metadata,omitempty"`
+	// Ladder is the encoding ladder chosen for this video.
+	Ladder *EncodingLadder `json:"Ladder,omitempty"`
+	// Loudness reports the EBU R128 measurements of every audio track when
+	// loudness normalization is enabled.
+	Loudness []AudioLoudness `json:"Loudness,omitempty"`
+	// Encrypted is set when the segments are AES-128 encrypted; such videos
+	// have no DASH manifest.
+	Encrypted bool `json:"Encrypted,omitempty"`
+	// FailureReason and FailureDetail are set when Phase is "failed": the
+	// reason is machine-readable, the detail is for humans.
+	FailureReason string `json:"FailureReason,omitempty"`
+	FailureDetail string `json:"FailureDetail,omitempty"`
+}
+
+// EncodingLadder records the ladder a video was encoded with, for analysis.
+type EncodingLadder struct {
+	Profile string `json:"Profile"`
+	ContentAware bool `json:"ContentAware"`
+	// Complexity is the measured bits per pixel of the content-aware test
+	// encodes; 0 when the ladder wasn't adapted.
+	Complexity float64 `json:"Complexity,omitempty"`
+	// Rungs lists the planned renditions, including any that failed to encode.
+	Rungs []LadderRung `json:"Rungs"`
+}
+
+// LadderRung is one rendition of an EncodingLadder.
+type LadderRung struct {
+	Name string `json:"Name"`
+	Codec string `json:"Codec"` // h264, hevc or av1
+	Width int `json:"Width"`
+	Height int `json:"Height"`
+	CRF int `json:"CRF"`
+	MaxBitrate string `json:"MaxBitrate"`
+	Bandwidth int `json:"Bandwidth"`
+	FrameRate float64 `json:"FrameRate"`
+	VideoRange string `json:"VideoRange"` // SDR, PQ or HLG
+	// Tonemap is set on SDR rungs of an HDR source.
+	Tonemap bool `json:"Tonemap,omitempty"`
+}
+
+// AudioLoudness is the loudness of one audio track as measured before
+// normalization. The measurements are only set when Normalized is; silent
+// tracks and tracks that couldn't be measured are left as they are.
+type AudioLoudness struct {
+	Rendition string `json:"Rendition"` // e.g. audio_0
+	Integrated float64 `json:"Integrated"` // LUFS
+	TruePeak float64 `json:"TruePeak"` // dBTP
+	Range float64 `json:"Range"` // LU
+	Threshold float64 `json:"Threshold"` // LUFS
+	Target float64 `json:"Target"` // LUFS
+	Normalized bool `json:"Normalized"`
+}
+
+// TranscodeProgressEvent reports how far a transcode has got. It is published
+// throttled and best effort, so consumers must not rely on seeing every stage.
+type TranscodeProgressEvent struct {
+	VideoId string `json:"VideoId"`
+	Stage string `json:"Stage"` // download, probe, encode or upload
+	// Percent is the progress of the current stage; while encoding it is the
+	// mean of the renditions' progress.
+	Percent float64 `json:"Percent"`
+	Renditions map[string]float64 `json:"Renditions,omitempty"`
+	// ETASeconds estimates the time left in the current stage, 0 if unknown
+	ETASeconds float64 `json:"ETASeconds,omitempty"`
+}
+
+// MediaMetadata is what ffprobe found in the uploaded source file.
+type MediaMetadata struct {
+	Container string `json:"Container"` // ffprobe format name, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	Duration float64 `json:"Duration"`
+	Bitrate int `json:"Bitrate"` // overall, bits per second
+	Size int64 `json:"Size"` // bytes
+	CreationTime string `json:"CreationTime,omitempty"` // as tagged by the recording device
+	Video VideoMetadata `json:"Video"`
+	Audio []AudioMetadata `json:"Audio,omitempty"`
+}
+
+// VideoMetadata describes the source's video stream.
+type VideoMetadata struct {
+	Codec string `json:"Codec"`
+	Profile string `json:"Profile,omitempty"`
+	// Width and Height are the coded size; DisplayWidth and DisplayHeight
+	// apply the sample aspect ratio and rotation.
+	Width int `json:"Width"`
+	Height int `json:"Height"`
+	DisplayWidth int `json:"DisplayWidth"`
+	DisplayHeight int `json:"DisplayHeight"`
+	FrameRate float64 `json:"FrameRate"`
+	Rotation int `json:"Rotation"` // clockwise degrees
+	Bitrate int `json:"Bitrate,omitempty"`
+	PixelFormat string `json:"PixelFormat"`
+	BitDepth int `json:"BitDepth"`
+	ColorPrimaries string `json:"ColorPrimaries,omitempty"`
+	ColorTransfer string `json:"ColorTransfer,omitempty"`
+	ColorSpace string `json:"ColorSpace,omitempty"`
+	HDR string `json:"HDR,omitempty"` // "PQ", "HLG" or "DolbyVision"; empty for SDR
+}
+
+// AudioMetadata describes one of the source's audio streams.
+type AudioMetadata struct {
+	Codec string `json:"Codec"`
+	Language string `json:"Language,omitempty"`
+	Channels int `json:"Channels"`
+	ChannelLayout string `json:"ChannelLayout,omitempty"`
+	SampleRate int `json:"SampleRate"`
+	Bitrate int `json:"Bitrate,omitempty"`
+}
+
+// Poster is one frame offered as the video's poster.
+type Poster struct {
+	// Time is the position in seconds the frame was taken from.
+	Time float64 `json:"Time"`
+	Images []PosterImage `json:"Images"`
+}
+
+// PosterImage is a poster rendered at one size and format.
+type PosterImage struct {
+	Key string `json:"Key"`
+	Width int `json:"Width"`
+	Height int `json:"Height"`
+	Format string `json:"Format"`
 }
 
 type Producer struct {